@@ -10,6 +10,7 @@ require (
 	golang.org/x/net v0.19.0
 	golang.org/x/time v0.5.0
 	gopkg.in/tucnak/telebot.v2 v2.5.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -18,5 +19,4 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/dddpaul/alfafin-bot/pkg/acl"
+	"github.com/dddpaul/alfafin-bot/pkg/budget"
+	"github.com/dddpaul/alfafin-bot/pkg/digest"
+	"github.com/dddpaul/alfafin-bot/pkg/gas"
+	"github.com/dddpaul/alfafin-bot/pkg/purchases"
 	"github.com/dddpaul/alfafin-bot/pkg/telegram"
+	"github.com/dddpaul/alfafin-bot/pkg/uploads"
 )
 
 var (
@@ -16,11 +27,32 @@ var (
 	trace            bool
 	telegramToken    string
 	telegramProxyURL string
-	telegramAdmin    string
+	telegramUsers    string
 	gasURL           string
 	gasProxyURL      string
 	gasClientID      string
 	gasClientSecret  string
+	dataDir          string
+	templatesFile    string
+	usersFile        string
+	reports          string
+	categoriesFile   string
+	budgets          string
+	digests          string
+	timezone         string
+	ratesFile        string
+	currenciesFile   string
+	webhookListen    string
+	webhookURL       string
+	webhookSecret    string
+	webhookCert      string
+	webhookKey       string
+	shutdownTimeout  time.Duration
+	uploadWorkers    int
+	uploadQueue      int
+	gasRetries       int
+	gasRetryTime     time.Duration
+	gasBatch         int
 )
 
 func main() {
@@ -28,11 +60,32 @@ func main() {
 	flag.BoolVar(&trace, "trace", false, "Enable network tracing")
 	flag.StringVar(&telegramToken, "telegram-token", LookupEnvOrString("TELEGRAM_TOKEN", ""), "Telegram API token")
 	flag.StringVar(&telegramProxyURL, "telegram-proxy-url", LookupEnvOrString("TELEGRAM_PROXY_URL", ""), "Telegram SOCKS5 proxy url")
-	flag.StringVar(&telegramAdmin, "telegram-admin", LookupEnvOrString("TELEGRAM_ADMIN", ""), "Telegram admin user")
+	flag.StringVar(&telegramUsers, "telegram-users", LookupEnvOrString("TELEGRAM_USERS", ""), "Comma separated Telegram user IDs with roles allowed to use bot, e.g. 123:admin,456:writer,789:reader")
+	flag.StringVar(&webhookURL, "webhook-url", LookupEnvOrString("WEBHOOK_URL", ""), "Public URL of Telegram webhook, long polling is used if empty")
+	flag.StringVar(&webhookListen, "webhook-listen", LookupEnvOrString("WEBHOOK_LISTEN", ":8080"), "Listen address of Telegram webhook")
+	flag.StringVar(&webhookSecret, "webhook-secret", LookupEnvOrString("WEBHOOK_SECRET", ""), "Secret token which Telegram sends with every webhook request, required in webhook mode")
+	flag.StringVar(&webhookCert, "webhook-cert", LookupEnvOrString("WEBHOOK_CERT", ""), "TLS certificate file of Telegram webhook, plain HTTP is served if empty")
+	flag.StringVar(&webhookKey, "webhook-key", LookupEnvOrString("WEBHOOK_KEY", ""), "TLS key file of Telegram webhook")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", LookupEnvOrDuration("SHUTDOWN_TIMEOUT", telegram.SHUTDOWN_DEFAULT), "Time to wait for uploads in progress on SIGTERM, unfinished ones are queued for retry")
+	flag.IntVar(&uploadWorkers, "upload-workers", LookupEnvOrInt("UPLOAD_WORKERS", uploads.WORKERS), "Number of concurrent uploads to GAS web apps")
+	flag.IntVar(&uploadQueue, "upload-queue", LookupEnvOrInt("UPLOAD_QUEUE", uploads.QUEUE_SIZE), "Number of purchases waiting for upload, new purchases wait when it's full")
+	flag.IntVar(&gasBatch, "gas-batch-size", LookupEnvOrInt("GAS_BATCH_SIZE", gas.BATCH_SIZE), fmt.Sprintf("Maximum number of queued purchases uploaded to GAS web app with a single request, up to %d, 1 disables batch uploads", gas.MAX_BATCH_SIZE))
+	flag.IntVar(&gasRetries, "gas-retries", LookupEnvOrInt("GAS_RETRIES", gas.MAX_RETRIES), "Number of attempts of GAS request on network errors, HTTP 429 and 5xx and temporary GAS errors")
+	flag.DurationVar(&gasRetryTime, "gas-retry-time", LookupEnvOrDuration("GAS_RETRY_TIME", gas.DefaultRetryPolicy().MaxElapsed), "Maximum time of GAS request attempts with exponentially growing delays between them")
 	flag.StringVar(&gasURL, "gas-url", LookupEnvOrString("GAS_URL", ""), "Google App Script URL")
 	flag.StringVar(&gasProxyURL, "gas-proxy-url", LookupEnvOrString("GAS_PROXY_URL", ""), "SOCKS5 proxy url for GAS web app")
 	flag.StringVar(&gasClientID, "gas-client-id", LookupEnvOrString("GAS_CLIENT_ID", ""), "This app client id for GAS web application")
 	flag.StringVar(&gasClientSecret, "gas-client-secret", LookupEnvOrString("GAS_CLIENT_SECRET", ""), "This app client secret for GAS web application")
+	flag.StringVar(&templatesFile, "templates-file", LookupEnvOrString("TEMPLATES_FILE", ""), "YAML or JSON file with additional parsing templates, reloaded on SIGHUP")
+	flag.StringVar(&reports, "reports", LookupEnvOrString("REPORTS", telegram.REPORTS_GAS), "Source of period reports: gas or local (computed from recorded purchases)")
+	flag.StringVar(&categoriesFile, "categories-file", LookupEnvOrString("CATEGORIES_FILE", ""), "YAML or JSON file with merchant categorisation rules")
+	flag.StringVar(&budgets, "budgets", LookupEnvOrString("BUDGETS", ""), "Comma separated monthly budgets in roubles, overall and by category, e.g. total=100000,Restaurants=15000")
+	flag.StringVar(&digests, "digests", LookupEnvOrString("DIGESTS", ""), "Comma separated times of summaries sent to admins, e.g. daily=09:00,weekly=10:00,monthly=10:00")
+	flag.StringVar(&timezone, "timezone", LookupEnvOrString("TIMEZONE", ""), "Timezone of reports and digests, e.g. Europe/Moscow, system one is used if empty")
+	flag.StringVar(&ratesFile, "rates-file", LookupEnvOrString("RATES_FILE", ""), "YAML or JSON file with exchange rate provider settings, static and overridden rates, CBR rates are used if empty")
+	flag.StringVar(&currenciesFile, "currencies-file", LookupEnvOrString("CURRENCIES_FILE", ""), "YAML or JSON file with additional currency symbols and aliases")
+	flag.StringVar(&usersFile, "users-file", LookupEnvOrString("USERS_FILE", ""), "YAML or JSON file with users having own GAS web app")
+	flag.StringVar(&dataDir, "data-dir", LookupEnvOrString("DATA_DIR", ""), "Directory for persistent bot state, state is kept in memory only if empty")
 
 	log.SetFormatter(&log.TextFormatter{
 		DisableColors: true,
@@ -40,6 +93,15 @@ func main() {
 	})
 
 	flag.Parse()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if len(timezone) > 0 {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			log.Panicf("Invalid timezone: %v", err)
+		}
+		time.Local = loc
+	}
 	log.Printf("Configuration %v, timezone %v", getConfig(flag.CommandLine), time.Local)
 
 	if verbose {
@@ -54,15 +116,111 @@ func main() {
 		log.Panic("Telegram API token has to be specified")
 	}
 
+	if len(templatesFile) > 0 {
+		if err := purchases.LoadTemplates(templatesFile); err != nil {
+			log.Panicf("Unable to load templates: %v", err)
+		}
+		log.Infof("Loaded %d templates from %s", len(purchases.Templates()), templatesFile)
+		go reloadTemplatesOnHUP(templatesFile)
+	}
+
+	if len(currenciesFile) > 0 {
+		if err := purchases.LoadCurrencies(currenciesFile); err != nil {
+			log.Panicf("Unable to load currencies: %v", err)
+		}
+		log.Infof("Loaded currencies from %s", currenciesFile)
+	}
+
+	if err := setupRates(ctx, ratesFile, dataDir); err != nil {
+		log.Panicf("Unable to set up exchange rates: %v", err)
+	}
+
+	users, err := acl.ParseUsers(telegramUsers)
+	if err != nil {
+		log.Panicf("Invalid Telegram users: %v", err)
+	}
+	// Admin was configured by username before, it can't be converted to user ID
+	if admin := os.Getenv("TELEGRAM_ADMIN"); admin != "" {
+		if len(users) == 0 {
+			log.Panicf("TELEGRAM_ADMIN is not supported anymore, set admin user ID in TELEGRAM_USERS instead, e.g. 123:admin")
+		}
+		log.Errorf("TELEGRAM_ADMIN=%s is ignored, admins are set in TELEGRAM_USERS", admin)
+	}
+
+	monthlyBudgets, err := budget.Parse(budgets)
+	if err != nil {
+		log.Panicf("Invalid budgets: %v", err)
+	}
+
+	schedule, err := digest.Parse(digests)
+	if err != nil {
+		log.Panicf("Invalid digests: %v", err)
+	}
+
+	retry := gas.DefaultRetryPolicy()
+	retry.MaxAttempts = gasRetries
+	retry.MaxElapsed = gasRetryTime
+
 	bot, err := telegram.NewBot(telegramToken,
-		telegram.WithAdmin(telegramAdmin),
+		telegram.WithACL(users),
 		telegram.WithSocks(telegramProxyURL),
-		telegram.WithGAS(gasURL, gasProxyURL, gasClientID, gasClientSecret))
+		telegram.WithGAS(gasURL, gasProxyURL, gasClientID, gasClientSecret),
+		telegram.WithGASRetry(retry),
+		telegram.WithGASBatch(gasBatch),
+		telegram.WithDataDir(dataDir),
+		telegram.WithUsersFile(usersFile),
+		telegram.WithReports(reports),
+		telegram.WithCategories(categoriesFile),
+		telegram.WithBudgets(monthlyBudgets),
+		telegram.WithDigests(schedule),
+		telegram.WithWebhook(webhookListen, webhookURL, webhookSecret, webhookCert, webhookKey),
+		telegram.WithShutdownTimeout(shutdownTimeout),
+		telegram.WithUploads(uploadWorkers, uploadQueue))
 	if err != nil {
 		panic(err)
 	}
 
-	bot.Start()
+	bot.Start(ctx)
+}
+
+// setupRates activates rate provider selected by config file. Rates fetched from network are cached
+// in data directory and today's ones are prefetched in background.
+func setupRates(ctx context.Context, path string, dir string) error {
+	cfg, err := purchases.LoadRatesConfig(path)
+	if err != nil {
+		return err
+	}
+	provider, err := cfg.NewProvider()
+	if err != nil {
+		return err
+	}
+	if cfg.Provider != purchases.STATIC_PROVIDER {
+		cachePath := ""
+		if len(dir) > 0 {
+			cachePath = filepath.Join(dir, "rates-"+cfg.Provider+".json")
+		}
+		cache, err := purchases.NewRatesCache(cachePath, provider)
+		if err != nil {
+			return err
+		}
+		go cache.Run(ctx, purchases.RATES_INTERVAL)
+		provider = cache
+	}
+	purchases.SetRateProvider(cfg.Wrap(provider))
+	log.Infof("Exchange rates are provided by %s, %d static rates, %d dates overridden", cfg.Provider, len(cfg.Static), len(cfg.Overrides))
+	return nil
+}
+
+func reloadTemplatesOnHUP(path string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := purchases.LoadTemplates(path); err != nil {
+			log.Errorf("Unable to reload templates, previous ones are kept: %v", err)
+			continue
+		}
+		log.Infof("Reloaded %d templates from %s", len(purchases.Templates()), path)
+	}
 }
 
 func LookupEnvOrString(key string, defaultVal string) string {
@@ -72,6 +230,28 @@ func LookupEnvOrString(key string, defaultVal string) string {
 	return defaultVal
 }
 
+func LookupEnvOrInt(key string, defaultVal int) int {
+	if val, ok := os.LookupEnv(key); ok {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			log.Panicf("Invalid %s: %v", key, err)
+		}
+		return n
+	}
+	return defaultVal
+}
+
+func LookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			log.Panicf("Invalid %s: %v", key, err)
+		}
+		return d
+	}
+	return defaultVal
+}
+
 func getConfig(fs *flag.FlagSet) []string {
 	cfg := make([]string, 0, 10)
 	fs.VisitAll(func(f *flag.Flag) {
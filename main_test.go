@@ -1,14 +1,35 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dddpaul/alfafin-bot/pkg/acl"
+	"github.com/dddpaul/alfafin-bot/pkg/budget"
+	"github.com/dddpaul/alfafin-bot/pkg/categories"
+	"github.com/dddpaul/alfafin-bot/pkg/digest"
+	"github.com/dddpaul/alfafin-bot/pkg/gas"
+	"github.com/dddpaul/alfafin-bot/pkg/history"
+	"github.com/dddpaul/alfafin-bot/pkg/outbox"
 	"github.com/dddpaul/alfafin-bot/pkg/stats"
+	"github.com/dddpaul/alfafin-bot/pkg/telegram"
+	"github.com/dddpaul/alfafin-bot/pkg/uploads"
+	"github.com/dddpaul/alfafin-bot/pkg/users"
 
 	"github.com/stretchr/testify/assert"
+	tb "gopkg.in/tucnak/telebot.v2"
 
 	"github.com/dddpaul/alfafin-bot/pkg/purchases"
 )
@@ -18,6 +39,27 @@ var (
 	ddmmyyyy = "02.01.2006"
 )
 
+// fakeRates returns fixed CBR rates of the dates used in tests and counts calls
+type fakeRates struct {
+	calls int
+}
+
+func (f *fakeRates) Rates(dt time.Time) (purchases.Rates, error) {
+	f.calls++
+	switch dt.Format(time.DateOnly) {
+	case "2023-08-16":
+		return purchases.Rates{"AMD": 0.251957, "USD": 97.3975}, nil
+	case "2024-06-14":
+		return purchases.Rates{"BYN": 27.59, "USD": 88.2065}, nil
+	}
+	return nil, fmt.Errorf("no rates for %s", dt.Format(time.DateOnly))
+}
+
+func TestMain(m *testing.M) {
+	purchases.SetRateProvider(&fakeRates{})
+	os.Exit(m.Run())
+}
+
 func TestNewPurchaseWithTemplate1(t *testing.T) {
 	p, err := newPurchase("Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
 	assert.Nil(t, err)
@@ -25,6 +67,12 @@ func TestNewPurchaseWithTemplate1(t *testing.T) {
 	assert.Equal(t, "Озон", p.Merchant)
 	assert.Equal(t, "**1111", p.Card)
 	assert.Equal(t, "₽", p.Currency)
+	assert.Equal(t, 4506.85, p.Balance)
+	assert.Equal(t, "Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽", p.Raw)
+
+	p1, _ := newPurchase("Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+	p1.Time = p.Time
+	assert.Equal(t, p.ID(), p1.ID(), "The same message should produce the same ID")
 
 	p, err = newPurchase("Покупка 527.11 ₽, Озон.\nКарта **1111. Баланс: 4506.85 ₽")
 	assert.Nil(t, err)
@@ -54,8 +102,26 @@ func TestNewPurchaseWithTemplate1(t *testing.T) {
 	p, err = newPurchase("Покупка ABC ₽,nОзон. Карта **1111. Баланс: 4506,85 ₽")
 	assert.NotNil(t, err)
 
-	p, err = newPurchase("Деньги пришли! 20 000 ₽ на карту\n**1111. Баланс: 21 945,39 ₽")
-	assert.NotNil(t, err)
+}
+
+func TestNewIncome(t *testing.T) {
+	p, err := newPurchase("Деньги пришли! 20 000 ₽ на карту\n**1111. Баланс: 21 945,39 ₽")
+	assert.Nil(t, err)
+	assert.Equal(t, purchases.Income, p.Operation)
+	assert.Equal(t, 20000.0, p.Price)
+	assert.Equal(t, 20000.0, p.PriceRUB)
+	assert.Equal(t, "**1111", p.Card)
+
+	p1, _ := newPurchase("Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+	assert.Equal(t, purchases.Buy, p1.Operation)
+
+	e := stats.NewExpenses()
+	e.Add(p)
+	e.Add(p1)
+	assert.Equal(t, int64(1), e.Count(), "Income should not be counted as expense")
+	assert.Equal(t, 527.11, e.Sum())
+	assert.Equal(t, 20000.0, e.Income())
+	assert.Equal(t, 20000.0-527.11, e.Net())
 }
 
 func TestNewPurchaseWithTemplate2(t *testing.T) {
@@ -101,6 +167,7 @@ func TestNewPurchaseWithTemplate4(t *testing.T) {
 	p, err := newPurchase("Покупка *1111: 62,50 RUR в bartello_BS Баланс: 17 403,67 RUR")
 	assert.Nil(t, err)
 	assert.Equal(t, 62.50, p.Price)
+	assert.Equal(t, 17403.67, p.Balance, "Currency should be stripped from balance")
 	assert.Equal(t, "bartello_BS", p.Merchant)
 	assert.Equal(t, "₽", p.Currency)
 	assert.Equal(t, p.Price, p.PriceRUB)
@@ -123,6 +190,7 @@ func TestStatsForSeveralPurchases(t *testing.T) {
 		},
 		Count: 3,
 		Sum:   p1.PriceRUB + p2.PriceRUB + p3.PriceRUB,
+		Net:   -(p1.PriceRUB + p2.PriceRUB + p3.PriceRUB),
 	}
 	assert.Equal(t, s.Count, e.Count())
 	j, err := json.Marshal(s)
@@ -144,3 +212,1105 @@ func roundFloat(val float64, precision uint) float64 {
 func truncateDay(dt time.Time) time.Time {
 	return dt.Truncate(time.Hour * 24)
 }
+
+func TestStatsFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	store := stats.NewStore(path)
+
+	e, err := store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), e.Count(), "Missing file should produce empty expenses")
+
+	dt := truncateDay(time.Now()).Unix()
+	e = stats.Expenses{dt: stats.Expense{Count: 2, Sum: 100.5}}
+	assert.Nil(t, store.Save(e))
+
+	e1, err := store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, e, e1)
+
+	jsonStats, err := e.Stats()
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, []byte(jsonStats), 0644))
+	e2, err := store.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, e, e2, "Output of /stats should be accepted for migration")
+}
+
+func TestStatsJSONInNegativeOffsetZone(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("EST", -5*60*60)
+	defer func() { time.Local = local }()
+
+	dt := time.Date(2024, 7, 17, 0, 0, 0, 0, time.UTC).Unix()
+	e := stats.Expenses{dt: stats.Expense{Count: 1, Sum: 10}}
+	j, err := json.Marshal(e)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"2024-07-17":{"count":1,"sum":10}}`, string(j))
+
+	e1 := stats.NewExpenses()
+	assert.Nil(t, json.Unmarshal(j, &e1))
+	assert.Equal(t, e, e1, "Days should survive restart west of UTC")
+}
+
+func TestOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	o, err := outbox.New(path)
+	assert.Nil(t, err)
+	p1, _ := newPurchase("Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+	p2, _ := newPurchase("Покупка 100 ₽, Лента.\nКарта **1111. Баланс: 4406,85 ₽")
+	item, err := o.Push(p1, fmt.Errorf("timeout"), &outbox.Reply{ChatID: 1, MessageID: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), item.ID)
+	assert.Equal(t, 1, item.Attempts)
+	assert.Equal(t, outbox.MIN_BACKOFF, item.NextTry.Sub(item.Created))
+	_, err = o.Push(p2, fmt.Errorf("timeout"), &outbox.Reply{ChatID: 1, MessageID: 20})
+	assert.Nil(t, err)
+
+	o, err = outbox.New(path)
+	assert.Nil(t, err)
+	items := o.List()
+	assert.Equal(t, 2, len(items), "Items should survive restart")
+	assert.Equal(t, p1.ID(), items[0].Purchase.ID())
+	assert.Equal(t, "timeout", items[0].LastError)
+	assert.Equal(t, 10, items[0].Reply.MessageID)
+
+	var sent []string
+	send := func(ctx context.Context, pp []*purchases.Purchase) []error {
+		errs := make([]error, len(pp))
+		for i, p := range pp {
+			sent = append(sent, p.Merchant)
+			if p.Merchant == "Лента" {
+				errs[i] = fmt.Errorf("code 1: error")
+			}
+		}
+		return errs
+	}
+	notified := map[int]bool{}
+	notify := func(ctx context.Context, item outbox.Item, delivered bool) {
+		notified[item.Reply.MessageID] = delivered
+	}
+	o.Drain(context.Background(), 10, send, notify)
+	assert.Empty(t, sent, "Items should wait for backoff")
+
+	due := func() {
+		for _, item := range o.Items {
+			item.NextTry = time.Now()
+		}
+	}
+	due()
+	o.Drain(context.Background(), 10, send, notify)
+	assert.Equal(t, []string{"Озон", "Лента"}, sent)
+	assert.Equal(t, map[int]bool{10: true}, notified, "Reply of delivered item should be edited")
+	items = o.List()
+	assert.Equal(t, 1, len(items), "Delivered item should be removed")
+	assert.Equal(t, p2.ID(), items[0].Purchase.ID())
+	assert.Equal(t, 2, items[0].Attempts)
+	assert.InDelta(t, float64(2*outbox.MIN_BACKOFF), float64(time.Until(items[0].NextTry)), float64(time.Second), "Backoff should double")
+
+	for i := 2; i < outbox.MAX_ATTEMPTS; i++ {
+		assert.Equal(t, outbox.PENDING, o.List()[0].Status)
+		due()
+		o.Drain(context.Background(), 10, send, notify)
+	}
+	items = o.List()
+	assert.Equal(t, map[int]bool{10: true, 20: false}, notified, "Reply of failed item should be edited")
+	assert.Equal(t, outbox.MAX_ATTEMPTS, items[0].Attempts)
+	assert.Equal(t, outbox.FAILED, items[0].Status)
+	assert.InDelta(t, float64(outbox.MAX_BACKOFF), float64(time.Until(items[0].NextTry)), float64(time.Second), "Backoff should be limited")
+	sent = nil
+	due()
+	o.Drain(context.Background(), 10, send, nil)
+	assert.Empty(t, sent, "Failed items should not be retried automatically")
+
+	n, err := o.Retry()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	o, err = outbox.New(path)
+	assert.Nil(t, err)
+	items = o.List()
+	assert.Equal(t, outbox.PENDING, items[0].Status)
+	assert.Equal(t, 0, items[0].Attempts)
+	assert.Equal(t, int64(3), o.NextID)
+}
+
+func TestFilterStatsInLocalZone(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+	for _, zone := range []*time.Location{time.FixedZone("EST", -5*60*60), time.FixedZone("MSK", 3*60*60)} {
+		time.Local = zone
+		e := stats.NewExpenses()
+		for _, dt := range []time.Time{
+			time.Date(2024, 6, 30, 23, 30, 0, 0, zone),
+			time.Date(2024, 7, 1, 1, 0, 0, 0, zone),
+			time.Date(2024, 7, 31, 23, 30, 0, 0, zone),
+			time.Date(2024, 8, 1, 0, 30, 0, 0, zone),
+		} {
+			p, err := purchases.New(dt, "Покупка 100 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+			assert.Nil(t, err)
+			e.Add(p)
+		}
+		period, err := stats.ParsePeriod("month", "2024-07", time.Now())
+		assert.Nil(t, err)
+		july := e.Filter(period)
+		assert.Equal(t, int64(2), july.Count(), zone.String())
+		assert.Equal(t, int64(1), july.Get(time.Date(2024, 7, 1, 1, 0, 0, 0, zone)).Count, zone.String())
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	defer purchases.SetTemplates(purchases.DefaultTemplates())
+
+	path := filepath.Join(t.TempDir(), "templates.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(`
+templates:
+  - name: manual-iso-date
+    pattern: "{date} {price} {currency} - {merchant}"
+    date_layout: "2006-01-02"
+    priority: 10
+  - name: refund
+    pattern: "Возврат {price} {currency}, {merchant}. Карта {card}."
+    operation: refund
+`), 0644))
+	assert.Nil(t, purchases.LoadTemplates(path))
+	assert.Equal(t, "manual-iso-date", purchases.Templates()[0].Name, "Template with higher priority should be tried first")
+
+	p, err := newPurchase("2024-07-01 100 RUB - Озон")
+	assert.Nil(t, err)
+	dt, _ := time.ParseInLocation(ddmmyyyy, "01.07.2024", time.Local)
+	assert.Equal(t, dt, p.Time)
+	assert.Equal(t, 100.0, p.Price)
+
+	p, err = newPurchase("Возврат 527,11 ₽, Озон. Карта **1111.")
+	assert.Nil(t, err)
+	assert.Equal(t, -527.11, p.Price)
+
+	assert.Nil(t, os.WriteFile(path, []byte("templates:\n  - name: broken\n"), 0644))
+	assert.NotNil(t, purchases.LoadTemplates(path))
+	assert.Equal(t, "manual-iso-date", purchases.Templates()[0].Name, "Templates should be kept intact on error")
+}
+
+func TestHistoryDeduplication(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	h, err := history.New(path)
+	assert.Nil(t, err)
+
+	p, _ := newPurchase("Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+	added, err := h.Add(p, false)
+	assert.Nil(t, err)
+	assert.True(t, added)
+
+	h, err = history.New(path)
+	assert.Nil(t, err)
+	assert.True(t, h.Contains(p), "History should survive restart")
+	added, _ = h.Add(p, false)
+	assert.False(t, added, "Duplicate should be skipped")
+	added, _ = h.Add(p, true)
+	assert.True(t, added, "Duplicate should be added when forced")
+	assert.Equal(t, 2, len(h.List()))
+}
+
+func TestCancelIsLinkedToOriginal(t *testing.T) {
+	h, _ := history.New("")
+	p1, _ := newPurchase("Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+	p1.Time = p1.Time.Add(-2 * time.Hour)
+	p2, _ := newPurchase("Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 3979,74 ₽")
+	p2.Time = p2.Time.Add(-1 * time.Hour)
+	p3, _ := newPurchase("Покупка 527,11 ₽, Озон.\nКарта **2222. Баланс: 4506,85 ₽")
+	for _, p := range []*purchases.Purchase{p1, p2, p3} {
+		h.Add(p, false)
+	}
+
+	c1, _ := newPurchase("Отмена операции 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+	h.Add(c1, false)
+	assert.Equal(t, p2.ID(), c1.CancelOf, "Cancel should be linked to the most recent purchase")
+
+	c2, _ := newPurchase("Отмена операции 527,11 ₽, Озон.\nКарта **1111. Баланс: 5033,96 ₽")
+	c2.Time = c2.Time.Add(time.Minute)
+	h.Add(c2, false)
+	assert.Equal(t, p1.ID(), c2.CancelOf, "Purchase should not be reversed twice")
+
+	c3, _ := newPurchase("Отмена операции 100 ₽, Озон.\nКарта **1111. Баланс: 5133,96 ₽")
+	h.Add(c3, false)
+	assert.Equal(t, "", c3.CancelOf)
+}
+
+func TestACL(t *testing.T) {
+	users, err := acl.ParseUsers("1:admin, 2:writer,3:reader,4")
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]acl.Role{1: acl.ADMIN, 2: acl.WRITER, 3: acl.READER, 4: acl.WRITER}, users)
+	_, err = acl.ParseUsers("1:root")
+	assert.NotNil(t, err)
+	_, err = acl.ParseUsers("alice:admin")
+	assert.NotNil(t, err)
+
+	path := filepath.Join(t.TempDir(), "acl.json")
+	a, err := acl.New(path, nil)
+	assert.Nil(t, err)
+	assert.False(t, a.Allowed(5, acl.READER), "Empty ACL should deny everything")
+	assert.False(t, a.Allowed(5, acl.ADMIN))
+
+	path = filepath.Join(t.TempDir(), "acl.json")
+	a, err = acl.New(path, users)
+	assert.Nil(t, err)
+	assert.True(t, a.Allowed(1, acl.ADMIN))
+	assert.True(t, a.Allowed(2, acl.READER))
+	assert.False(t, a.Allowed(3, acl.WRITER))
+	assert.False(t, a.Allowed(5, acl.READER))
+
+	assert.Nil(t, a.Grant(5, acl.READER))
+	ok, err := a.Revoke(3)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	a, err = acl.New(path, nil)
+	assert.Nil(t, err)
+	assert.True(t, a.Allowed(5, acl.READER), "Granted role should survive restart")
+	assert.False(t, a.Allowed(3, acl.READER), "Revoked role should survive restart")
+	assert.Equal(t, []int64{1}, a.Admins())
+
+	a, err = acl.New(path, users)
+	assert.Nil(t, err)
+	assert.False(t, a.Allowed(3, acl.READER), "Initial users should not undo revoke on restart")
+	assert.True(t, a.Allowed(5, acl.READER))
+}
+
+func TestLocalReport(t *testing.T) {
+	now := time.Date(2024, 7, 17, 12, 0, 0, 0, time.Local) // Wednesday
+	week, err := stats.NewPeriod("week", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 7, 15, 0, 0, 0, 0, time.Local), week.From)
+	assert.Equal(t, time.Date(2024, 7, 22, 0, 0, 0, 0, time.Local), week.To)
+	_, err = stats.NewPeriod("decade", now)
+	assert.NotNil(t, err)
+
+	pp := []*purchases.Purchase{
+		{Time: now, Price: 100, Merchant: "Озон", Currency: "₽", PriceRUB: 100},
+		{Time: now, Price: 50, Merchant: "Озон", Currency: "₽", PriceRUB: 50},
+		{Time: now, Price: 10, Merchant: "YANDEX GO", Currency: "$", PriceRUB: 900},
+		{Time: now, Operation: purchases.Income, Price: 1000, Currency: "₽", PriceRUB: 1000},
+		{Time: now.AddDate(0, 0, -7), Price: 100, Merchant: "Озон", Currency: "₽", PriceRUB: 100},
+	}
+	r := stats.NewReport(pp, week)
+	assert.Equal(t, int64(3), r.Count)
+	assert.Equal(t, 1050.0, r.Sum)
+	assert.Equal(t, 1000.0, r.Income)
+	assert.Equal(t, []stats.Total{
+		{Name: "YANDEX GO", Count: 1, Sum: 10, SumRUB: 900},
+		{Name: "Озон", Count: 2, Sum: 150, SumRUB: 150},
+	}, r.Merchants)
+	assert.Equal(t, "$", r.Currencies[0].Name)
+	assert.Contains(t, r.String(), "Week 15.07.2024 - 21.07.2024: 3 purchases, 1050.00 ₽")
+}
+
+func TestFormatStats(t *testing.T) {
+	assert.Equal(t, "No expenses yet", stats.NewExpenses().Format())
+
+	d1 := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC).Unix()
+	d2 := time.Date(2024, 7, 2, 0, 0, 0, 0, time.UTC).Unix()
+	e := stats.Expenses{
+		d1: stats.Expense{Count: 1, Sum: 100},
+		d2: stats.Expense{Count: 2, Sum: 300, Income: 1000},
+	}
+	s := e.Format()
+	assert.Contains(t, s, "Total          3       400.00")
+	assert.Contains(t, s, "Average per day: 200.00 ₽")
+	assert.Contains(t, s, "Biggest day: 02.07.2024, 300.00 ₽")
+	assert.Contains(t, s, "Income: 1000.00 ₽, net: 600.00 ₽")
+
+	// Reports are built while handlers add purchases
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			p, _ := purchases.New(time.Unix(d1, 0).AddDate(0, 0, i), "Покупка 100 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+			e.Add(p)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		e.Format()
+		e.Filter(stats.Period{From: time.Unix(d1, 0), To: time.Unix(d2, 0)})
+	}
+	<-done
+}
+
+func TestParsePeriod(t *testing.T) {
+	now := time.Date(2024, 7, 17, 12, 0, 0, 0, time.Local)
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.Local) }
+
+	for _, tc := range []struct {
+		name, arg string
+		from, to  time.Time
+	}{
+		{"today", "", day(2024, 7, 17), day(2024, 7, 18)},
+		{"today", "-1", day(2024, 7, 16), day(2024, 7, 17)},
+		{"today", "01.02.2024", day(2024, 2, 1), day(2024, 2, 2)},
+		{"week", "-1", day(2024, 7, 8), day(2024, 7, 15)},
+		{"month", "", day(2024, 7, 1), day(2024, 8, 1)},
+		{"month", "-7", day(2023, 12, 1), day(2024, 1, 1)},
+		{"month", "2024-02", day(2024, 2, 1), day(2024, 3, 1)},
+		{"month", "02.2024", day(2024, 2, 1), day(2024, 3, 1)},
+		{"year", "2023", day(2023, 1, 1), day(2024, 1, 1)},
+		{"range", "01.07.2024 15.07.2024", day(2024, 7, 1), day(2024, 7, 16)},
+		{"range", "01.07.2024", day(2024, 7, 1), day(2024, 7, 18)},
+	} {
+		p, err := stats.ParsePeriod(tc.name, tc.arg, now)
+		assert.Nil(t, err, tc.name+" "+tc.arg)
+		assert.Equal(t, tc.from, p.From, tc.name+" "+tc.arg)
+		assert.Equal(t, tc.to, p.To, tc.name+" "+tc.arg)
+	}
+
+	for _, tc := range [][]string{{"week", "2024-07"}, {"month", "July"}, {"range", ""}, {"range", "15.07.2024 01.07.2024"}, {"today", "-x"}} {
+		_, err := stats.ParsePeriod(tc[0], tc[1], now)
+		assert.NotNil(t, err, tc[0]+" "+tc[1])
+	}
+}
+
+func TestCategories(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "categories.yaml")
+	assert.Nil(t, os.WriteFile(file, []byte(`
+rules:
+  - pattern: Озон
+    category: Marketplaces
+  - match: prefix
+    pattern: yandex
+    category: Taxi
+  - match: regex
+    pattern: "(?i)restoran|cafe"
+    category: Restaurants
+`), 0644))
+	path := filepath.Join(dir, "categories.json")
+
+	r, err := categories.New(file, path)
+	assert.Nil(t, err)
+	assert.Equal(t, "Marketplaces", r.Categorize("озон"))
+	assert.Equal(t, "Taxi", r.Categorize("YANDEX GO"))
+	assert.Equal(t, "Restaurants", r.Categorize("RESTORAN \"ABC\""))
+	assert.Equal(t, "", r.Categorize("bartello_BS"))
+
+	assert.Nil(t, r.Set("YANDEX GO", "Transport"))
+	r, err = categories.New(file, path)
+	assert.Nil(t, err)
+	assert.Equal(t, "Transport", r.Categorize("YANDEX GO"), "User rule should survive restart and take precedence")
+	assert.Equal(t, "Taxi", r.Categorize("YANDEX TAXI"))
+
+	assert.Nil(t, os.WriteFile(file, []byte("rules:\n  - match: fuzzy\n    pattern: x\n    category: y\n"), 0644))
+	_, err = categories.New(file, path)
+	assert.NotNil(t, err)
+}
+
+func TestBreakdowns(t *testing.T) {
+	now := time.Date(2024, 7, 17, 12, 0, 0, 0, time.Local)
+	pp := []*purchases.Purchase{
+		{Time: now.AddDate(0, -1, 0), Price: 100, Merchant: "Озон", Card: "*1111", Currency: "₽", PriceRUB: 100},
+		{Time: now.AddDate(0, 0, -1), Price: 100, Merchant: "Озон", Card: "*1111", Currency: "₽", PriceRUB: 100, Category: "Marketplaces"},
+		{Time: now, Price: 50, Merchant: "Озон", Card: "*2222", Currency: "₽", PriceRUB: 50, Category: "Marketplaces"},
+		{Time: now, Price: 10, Merchant: "YANDEX GO", Card: "*1111", Currency: "$", PriceRUB: 900, Category: "Taxi"},
+	}
+	month, _ := stats.NewPeriod("month", now)
+
+	assert.Equal(t, []stats.Total{
+		{Name: "*1111", Count: 2, Sum: 110, SumRUB: 1000},
+		{Name: "*2222", Count: 1, Sum: 50, SumRUB: 50},
+	}, stats.GroupBy(pp, month, stats.ByCard))
+
+	top := stats.Top(pp, month, 1)
+	assert.Contains(t, top, "Top 1 for month 01.07.2024 - 31.07.2024, compared to 01.06.2024 - 30.06.2024")
+	assert.Contains(t, top, "Merchants:\n  YANDEX GO: 1, 900.00 ₽ (new)")
+	assert.NotContains(t, top, "Озон")
+
+	year, _ := stats.NewPeriod("year", now)
+	merchant := stats.Merchant(pp, year, "озон")
+	assert.Contains(t, merchant, "озон for year 01.01.2024 - 31.12.2024: 3 purchases, 250.00 ₽ (new)")
+	assert.Contains(t, merchant, "06.2024: 1, 100.00 ₽\n  07.2024: 2, 150.00 ₽")
+	assert.Contains(t, stats.Merchant(pp, month, "Озон"), "Озон for month 01.07.2024 - 31.07.2024: 2 purchases, 150.00 ₽ (+50%)")
+}
+
+func TestBudgetAlerts(t *testing.T) {
+	b, err := budget.Parse("total=1000, Taxi=200")
+	assert.Nil(t, err)
+	assert.Equal(t, budget.Budgets{"total": 1000, "Taxi": 200}, b)
+	_, err = budget.Parse("Taxi")
+	assert.NotNil(t, err)
+
+	now := time.Now()
+	var pp []*purchases.Purchase
+	add := func(price float64, category string) []string {
+		p := &purchases.Purchase{Time: now, Price: price, Currency: "₽", PriceRUB: price, Category: category}
+		pp = append(pp, p)
+		return b.Alerts(pp, p)
+	}
+	assert.Empty(t, add(100, "Taxi"))
+	alerts := add(70, "Taxi")
+	assert.Equal(t, 1, len(alerts))
+	assert.Contains(t, alerts[0], "Budget Taxi for "+now.Format("01.2006")+" reached 80%")
+	assert.Empty(t, add(10, "Taxi"), "Alert should be sent once per threshold")
+	alerts = add(700, "")
+	assert.Equal(t, 1, len(alerts))
+	assert.Contains(t, alerts[0], "Budget total for "+now.Format("01.2006")+" reached 80%")
+	alerts = add(150, "Taxi")
+	assert.Equal(t, 2, len(alerts), "Both total and category budgets should be exceeded")
+	assert.Contains(t, alerts[0], "reached 100%")
+
+	month, _ := stats.NewPeriod("month", now)
+	status := b.Status(pp, month)
+	assert.Equal(t, []budget.Status{{Name: "total", Limit: 1000, Spent: 1030}, {Name: "Taxi", Limit: 200, Spent: 330}}, status)
+	assert.Equal(t, -130.0, status[1].Remaining())
+}
+
+func TestDigests(t *testing.T) {
+	dd, err := digest.Parse("daily=09:00, weekly=10:30,monthly=08:15")
+	assert.Nil(t, err)
+	assert.Equal(t, []digest.Digest{{Kind: digest.DAILY, Hour: 9}, {Kind: digest.WEEKLY, Hour: 10, Minute: 30}, {Kind: digest.MONTHLY, Hour: 8, Minute: 15}}, dd)
+	_, err = digest.Parse("hourly=09:00")
+	assert.NotNil(t, err)
+	_, err = digest.Parse("daily=9")
+	assert.NotNil(t, err)
+
+	// Wednesday
+	now := time.Date(2024, 7, 17, 9, 30, 0, 0, time.Local)
+	daily, weekly, monthly := dd[0], dd[1], dd[2]
+	assert.Equal(t, time.Date(2024, 7, 18, 9, 0, 0, 0, time.Local), daily.Next(now))
+	assert.Equal(t, time.Date(2024, 7, 22, 10, 30, 0, 0, time.Local), weekly.Next(now))
+	assert.Equal(t, time.Date(2024, 8, 1, 8, 15, 0, 0, time.Local), monthly.Next(now))
+	assert.Equal(t, time.Date(2024, 7, 17, 10, 0, 0, 0, time.Local), digest.Digest{Kind: digest.DAILY, Hour: 10}.Next(now))
+	assert.Equal(t, time.Date(2024, 7, 22, 10, 30, 0, 0, time.Local), weekly.Next(time.Date(2024, 7, 15, 10, 30, 0, 0, time.Local)))
+
+	p, err := daily.Period(daily.Next(now))
+	assert.Nil(t, err)
+	assert.Equal(t, "17.07.2024", p.String())
+	p, err = weekly.Period(weekly.Next(now))
+	assert.Nil(t, err)
+	assert.Equal(t, "15.07.2024 - 21.07.2024", p.String())
+	p, err = monthly.Period(monthly.Next(now))
+	assert.Nil(t, err)
+	assert.Equal(t, "01.07.2024 - 31.07.2024", p.String())
+}
+
+func TestRatesCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	provider := &fakeRates{}
+	c, err := purchases.NewRatesCache(path, provider)
+	assert.Nil(t, err)
+
+	dt := time.Date(2023, 8, 16, 7, 36, 0, 0, time.Local)
+	rates, err := c.Rates(dt)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.251957, rates["AMD"])
+	_, err = c.Rates(dt.Add(12 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, provider.calls, "Rates of the same date should be fetched once")
+
+	_, err = c.Rates(time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local))
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, provider.calls)
+
+	provider1 := &fakeRates{}
+	c, err = purchases.NewRatesCache(path, provider1)
+	assert.Nil(t, err)
+	rates, err = c.Rates(dt)
+	assert.Nil(t, err)
+	assert.Equal(t, 97.3975, rates["USD"])
+	assert.Equal(t, 0, provider1.calls, "Rates should be loaded from file")
+}
+
+func TestRateProviders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.yaml")
+	err := os.WriteFile(path, []byte(`
+static:
+  GEL: 33.5
+overrides:
+  2023-08-16:
+    AMD: 0.25
+`), 0644)
+	assert.Nil(t, err)
+	cfg, err := purchases.LoadRatesConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, purchases.CBR_PROVIDER, cfg.Provider)
+
+	provider := cfg.Wrap(&fakeRates{})
+	rates, err := provider.Rates(time.Date(2023, 8, 16, 7, 36, 0, 0, time.Local))
+	assert.Nil(t, err)
+	assert.Equal(t, purchases.Rates{"AMD": 0.25, "USD": 97.3975, "GEL": 33.5}, rates)
+	rates, err = provider.Rates(time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local))
+	assert.NotNil(t, err)
+	assert.Equal(t, 33.5, rates["GEL"], "Static rates should be available when provider fails")
+
+	_, err = (&purchases.RatesConfig{Provider: "unknown"}).NewProvider()
+	assert.NotNil(t, err)
+
+	feed := `<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+	<Cube>
+		<Cube time="2024-06-14"><Cube currency="USD" rate="1.0714"/><Cube currency="GEL" rate="3.05"/></Cube>
+		<Cube time="2024-06-13"><Cube currency="USD" rate="1.08"/><Cube currency="GEL" rate="3.1"/></Cube>
+	</Cube>
+</gesmes:Envelope>`
+	var downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		w.Write([]byte(feed))
+	}))
+	defer server.Close()
+	ecb := purchases.NewECB(server.URL, purchases.StaticRates{"EUR": 95.0})
+	rates, err = ecb.Rates(time.Date(2024, 6, 16, 12, 0, 0, 0, time.Local))
+	assert.Nil(t, err)
+	assert.Equal(t, 95.0, rates["EUR"])
+	assert.Equal(t, roundFloat(95.0/1.0714, 4), roundFloat(rates["USD"], 4), "Rates of the latest date before weekend should be used")
+	assert.Equal(t, roundFloat(95.0/3.05, 4), roundFloat(rates["GEL"], 4))
+	_, err = ecb.Rates(time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local))
+	assert.NotNil(t, err)
+	rates, err = ecb.Rates(time.Date(2024, 6, 13, 12, 0, 0, 0, time.Local))
+	assert.Nil(t, err)
+	assert.Equal(t, roundFloat(95.0/1.08, 4), roundFloat(rates["USD"], 4))
+	assert.Equal(t, 1, downloads, "Feed should be downloaded once for all dates")
+}
+
+func TestCurrencies(t *testing.T) {
+	for _, s := range []string{"USD", "usd", "$", "US$"} {
+		c, ok := purchases.LookupCurrency(s)
+		assert.True(t, ok, s)
+		assert.Equal(t, purchases.Currency{Code: "USD", Symbol: "$", Aliases: c.Aliases}, c, s)
+	}
+	for _, s := range []string{"RUR", "RUB", "₽", "руб."} {
+		c, ok := purchases.LookupCurrency(s)
+		assert.True(t, ok, s)
+		assert.Equal(t, "RUB", c.Code, s)
+	}
+	c, ok := purchases.LookupCurrency("PEN")
+	assert.True(t, ok)
+	assert.Equal(t, "PEN", c.Symbol, "ISO code should be used as symbol by default")
+	_, ok = purchases.LookupCurrency("XYZ")
+	assert.False(t, ok)
+
+	purchases.SetRateProvider(purchases.StaticRates{"GEL": 33.5})
+	defer purchases.SetRateProvider(&fakeRates{})
+	p, err := newPurchase("**1111 Pokupka 12,50 GEL Balans 10 000,12 RUR KHINKALI 16.08.2023 07:36")
+	assert.Nil(t, err)
+	assert.Equal(t, "₾", p.Currency)
+	assert.Equal(t, "GEL", p.CurrencyCode)
+	assert.Equal(t, 418.75, p.PriceRUB)
+	_, err = newPurchase("**1111 Pokupka 12,50 TRY Balans 10 000,12 RUR KEBAB 16.08.2023 07:36")
+	assert.NotNil(t, err, "Currency without exchange rate should not be parsed")
+
+	path := filepath.Join(t.TempDir(), "currencies.yaml")
+	err = os.WriteFile(path, []byte(`
+currencies:
+  - code: jpy
+    symbol: ¥
+    aliases: [yen]
+  - code: XYZ
+`), 0644)
+	assert.Nil(t, err)
+	assert.Nil(t, purchases.LoadCurrencies(path))
+	defer purchases.SetCurrencies(purchases.DefaultCurrencies())
+	c, _ = purchases.LookupCurrency("¥")
+	assert.Equal(t, "JPY", c.Code)
+	c, _ = purchases.LookupCurrency("Yen")
+	assert.Equal(t, "JPY", c.Code)
+	c, _ = purchases.LookupCurrency("RMB")
+	assert.Equal(t, "CNY", c.Code)
+	c, ok = purchases.LookupCurrency("XYZ")
+	assert.True(t, ok)
+	assert.Equal(t, "XYZ", c.Symbol)
+}
+
+func TestWebhook(t *testing.T) {
+	wh := telegram.NewWebhook("", "https://bot.example.com/hook", "secret", "", "")
+	dest := make(chan tb.Update, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go wh.Poll(nil, dest, stop)
+
+	post := func(secret string, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+		if secret != "" {
+			r.Header.Set(telegram.SECRET_HEADER, secret)
+		}
+		w := httptest.NewRecorder()
+		wh.ServeHTTP(w, r)
+		return w.Code
+	}
+	update := `{"update_id": 1, "message": {"message_id": 2, "text": "/status"}}`
+	assert.Equal(t, http.StatusUnauthorized, post("", update))
+	assert.Equal(t, http.StatusUnauthorized, post("wrong", update))
+	assert.Equal(t, http.StatusBadRequest, post("secret", "{"))
+	assert.Equal(t, http.StatusOK, post("secret", update))
+	upd := <-dest
+	assert.Equal(t, 1, upd.ID)
+	assert.Equal(t, "/status", upd.Message.Text)
+
+	_, err := telegram.NewBot("token", telegram.WithWebhook(":0", "https://bot.example.com/hook", "", "", ""))
+	assert.NotNil(t, err, "Webhook without secret should be refused")
+}
+
+func TestUsersGASURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	r, err := users.New(path)
+	assert.Nil(t, err)
+	assert.NotNil(t, r.Register(&users.User{ID: 1, GASURL: "https://script.google.com/%zz"}))
+	assert.NotNil(t, r.Register(&users.User{ID: 1, GASURL: "script.google.com/macros/s/1/exec"}))
+	assert.Nil(t, r.Register(&users.User{ID: 2, GASURL: "https://script.google.com/macros/s/2/exec"}))
+
+	r, err = users.New(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(r.List()), "Invalid URL should not be saved")
+
+	_, err = gas.NewClient("https://script.google.com/%zz", "", "id", "secret")
+	assert.NotNil(t, err)
+}
+
+func TestDuplicates(t *testing.T) {
+	d := telegram.NewDuplicates(2)
+	chat := &tb.Chat{ID: 1}
+	original := &tb.Message{ID: 1, Chat: chat, Text: "Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽"}
+	reply := &tb.Message{ID: 2, Chat: chat, Text: "Already recorded"}
+	d.Add(reply, original)
+	assert.Equal(t, original, d.Original(&tb.Message{ID: 2, Chat: chat}), "/force reply to the bot's reply should find original message")
+	assert.Nil(t, d.Original(&tb.Message{ID: 2, Chat: &tb.Chat{ID: 2}}))
+	assert.Nil(t, d.Original(original))
+
+	d.Add(&tb.Message{ID: 3, Chat: chat}, original)
+	d.Add(&tb.Message{ID: 4, Chat: chat}, original)
+	assert.Nil(t, d.Original(reply), "The oldest reply should be forgotten")
+	assert.Equal(t, original, d.Original(&tb.Message{ID: 4, Chat: chat}))
+}
+
+func TestUploadPool(t *testing.T) {
+	pool := uploads.New(1, 1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	assert.Nil(t, pool.Submit(context.Background(), func(ctx context.Context) (int, int) {
+		close(started)
+		<-release
+		return 3, 0
+	}))
+	<-started
+	assert.Nil(t, pool.Submit(context.Background(), func(ctx context.Context) (int, int) {
+		return 1, 1
+	}))
+	assert.Equal(t, 1, pool.Len())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := pool.Submit(ctx, func(ctx context.Context) (int, int) { return 0, 0 })
+	assert.Equal(t, context.DeadlineExceeded, err, "Submit should wait while the queue is full")
+
+	close(release)
+	assert.True(t, pool.Close(time.Second))
+	s := pool.Stats()
+	assert.Equal(t, uploads.Stats{Done: 4, Failed: 1, Average: s.Average}, s, "Items of all jobs should be counted")
+	assert.Equal(t, uploads.ErrClosed, pool.Submit(context.Background(), func(ctx context.Context) (int, int) { return 0, 0 }))
+
+	pool = uploads.New(1, 1)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, pool.Submit(context.Background(), func(ctx context.Context) (int, int) { return 0, 0 }))
+	}
+	assert.True(t, pool.Close(time.Second))
+	assert.Equal(t, uploads.Stats{}, pool.Stats(), "Jobs with nothing to do should not be counted")
+
+	pool = uploads.New(1, 1)
+	assert.Nil(t, pool.Submit(context.Background(), func(ctx context.Context) (int, int) {
+		<-ctx.Done()
+		return 0, 1
+	}))
+	assert.False(t, pool.Close(10*time.Millisecond), "Job should be cancelled when close timeout is exceeded")
+	assert.Equal(t, int64(1), pool.Stats().Failed)
+}
+
+// fakeClock advances time instantly by the requested delays
+type fakeClock struct {
+	now    time.Time
+	delays []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.delays = append(c.delays, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestRetryPolicy(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	policy := gas.RetryPolicy{InitialInterval: time.Second, MaxInterval: 5 * time.Second, Multiplier: 2, MaxAttempts: 10, MaxElapsed: 20 * time.Second, Clock: clock}
+	attempts := 0
+	err := policy.Do(context.Background(), func(ctx context.Context, attempt int) error {
+		attempts++
+		return gas.Retryable(fmt.Errorf("temporary"))
+	})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "retry time 20s is exceeded after 6 attempts")
+	assert.Equal(t, 6, attempts)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, clock.delays)
+
+	attempts = 0
+	err = policy.Do(context.Background(), func(ctx context.Context, attempt int) error {
+		attempts++
+		return fmt.Errorf("permanent")
+	})
+	assert.Equal(t, "permanent", err.Error())
+	assert.Equal(t, 1, attempts, "Permanent error should not be retried")
+
+	policy.MaxAttempts = 3
+	err = policy.Do(context.Background(), func(ctx context.Context, attempt int) error {
+		if attempt < 3 {
+			return gas.Retryable(fmt.Errorf("temporary"))
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	policy.Clock = nil
+	policy.InitialInterval = time.Hour
+	err = policy.Do(ctx, func(ctx context.Context, attempt int) error {
+		return gas.Retryable(fmt.Errorf("temporary"))
+	})
+	assert.ErrorIs(t, err, context.Canceled, "Waiting for retry should be interrupted by context")
+
+	policy = gas.DefaultRetryPolicy()
+	for i := 0; i < 100; i++ {
+		d := policy.Backoff(1)
+		assert.True(t, d >= 1600*time.Millisecond && d <= 2400*time.Millisecond, d)
+	}
+}
+
+func TestGASRetries(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Query().Get("command"))
+		switch len(requests) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Write([]byte(`{"status": 2, "message": "busy"}`))
+		case 3:
+			w.Write([]byte(`{"status": 0, "message": "10 purchases"}`))
+		default:
+			w.Write([]byte(`{"status": 1, "message": "unknown command"}`))
+		}
+	}))
+	defer server.Close()
+	policy := gas.RetryPolicy{InitialInterval: time.Millisecond, Multiplier: 1, MaxAttempts: 5, Clock: &fakeClock{}}
+	client, err := gas.NewClient(server.URL, "", "id", "secret", gas.WithRetryPolicy(policy))
+	assert.Nil(t, err)
+
+	resp, err := client.Get(context.Background(), "today", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "10 purchases", resp)
+	assert.Equal(t, []string{"today", "today", "today"}, requests, "HTTP 503 and temporary error should be retried")
+
+	_, err = client.Get(context.Background(), "unknown", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, 4, len(requests), "GAS error should not be retried")
+}
+
+func TestGASBatch(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var items []map[string]string
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&items))
+		assert.Equal(t, 3, len(items))
+		// Results are listed in reverse order, so they have to be mapped back by id
+		fmt.Fprintf(w, `{"status": 0, "results": [{"id": "%s", "status": 0, "message": "%s"}, {"id": "%s", "status": 1, "message": "duplicate"}]}`,
+			items[2]["id"], items[2]["merchant"], items[0]["id"])
+	}))
+	defer server.Close()
+	client, err := gas.NewClient(server.URL, "", "id", "secret")
+	assert.Nil(t, err)
+
+	p1, _ := newPurchase("Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+	p2, _ := newPurchase("Покупка 100 ₽, Пятёрочка.\nКарта **1111. Баланс: 4406,85 ₽")
+	p3, _ := newPurchase("Покупка 200 ₽, Лента.\nКарта **1111. Баланс: 4206,85 ₽")
+	results, err := client.AddBatch(context.Background(), []*purchases.Purchase{p1, p2, p3})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 3, len(results))
+	assert.EqualError(t, results[0].Err, "code 1: duplicate")
+	assert.NotNil(t, results[1].Err, "purchase without result should fail")
+	assert.Nil(t, results[2].Err)
+	assert.Equal(t, "Лента", results[2].Message)
+
+	// Results of repeated purchase are mapped by position
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var items []map[string]string
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&items))
+		assert.Equal(t, 2, len(items))
+		fmt.Fprintf(w, `{"status": 0, "results": [{"id": "%s", "status": 0, "message": "row 1"}, {"id": "%s", "status": 0, "message": "row 2"}]}`,
+			items[0]["id"], items[1]["id"])
+	}))
+	defer server.Close()
+	client, err = gas.NewClient(server.URL, "", "id", "secret")
+	assert.Nil(t, err)
+	results, err = client.AddBatch(context.Background(), []*purchases.Purchase{p1, p1})
+	assert.Nil(t, err)
+	assert.Equal(t, []gas.Result{{Message: "row 1"}, {Message: "row 2"}}, results)
+
+	var batches, singles int
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") == "application/json" {
+			batches++
+		} else {
+			singles++
+		}
+		w.Write([]byte(`{"status": 0, "message": "added"}`))
+	}))
+	defer server.Close()
+	client, err = gas.NewClient(server.URL, "", "id", "secret")
+	assert.Nil(t, err)
+	results, err = client.AddBatch(context.Background(), []*purchases.Purchase{p1, p2})
+	assert.Nil(t, err)
+	assert.Equal(t, []gas.Result{{Message: "added"}, {Message: "added"}}, results, "Purchases should be uploaded one by one")
+	results, err = client.AddBatch(context.Background(), []*purchases.Purchase{p3})
+	assert.Nil(t, err)
+	assert.Equal(t, []gas.Result{{Message: "added"}}, results)
+	assert.Equal(t, 1, batches, "Batches should not be sent after reply without results")
+	assert.Equal(t, 3, singles)
+
+	_, err = telegram.NewBot("token", telegram.WithGASBatch(gas.MAX_BATCH_SIZE+1))
+	assert.NotNil(t, err, "Batch which doesn't fit into GAS execution time should be refused")
+}
+
+// fakeTelegram is Bot API server which delivers queued updates to the bot and records messages sent by it
+type fakeTelegram struct {
+	*httptest.Server
+	updates  chan tb.Update
+	mu       sync.Mutex
+	nextID   int
+	messages map[int64][]string // Texts of sent and edited messages by chat
+	delay    time.Duration      // Delay of responses to sent messages, they are recorded before it
+}
+
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	f := &fakeTelegram{updates: make(chan tb.Update, 100), nextID: 1000, messages: make(map[int64][]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params map[string]string
+		json.NewDecoder(r.Body).Decode(&params)
+		switch path.Base(r.URL.Path) {
+		case "getMe":
+			fmt.Fprint(w, `{"ok": true, "result": {"id": 100, "is_bot": true, "username": "test_bot"}}`)
+		case "getUpdates":
+			var updates []tb.Update
+			select {
+			case upd := <-f.updates:
+				updates = append(updates, upd)
+			case <-time.After(20 * time.Millisecond):
+			}
+			json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": updates})
+		case "sendMessage", "editMessageText":
+			chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+			f.mu.Lock()
+			f.messages[chatID] = append(f.messages[chatID], params["text"])
+			id, _ := strconv.Atoi(params["message_id"])
+			if id == 0 {
+				f.nextID++
+				id = f.nextID
+			}
+			f.mu.Unlock()
+			time.Sleep(f.delay)
+			json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": map[string]any{
+				"message_id": id, "chat": map[string]any{"id": chatID, "type": "private"}, "text": params["text"]}})
+		default:
+			fmt.Fprint(w, `{"ok": true, "result": true}`)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// send delivers text message from the user to the bot
+func (f *fakeTelegram) send(userID int64, text string) {
+	f.mu.Lock()
+	f.nextID++
+	id := f.nextID
+	f.mu.Unlock()
+	f.updates <- tb.Update{ID: id, Message: &tb.Message{
+		ID:       id,
+		Sender:   &tb.User{ID: userID},
+		Chat:     &tb.Chat{ID: userID, Type: tb.ChatPrivate},
+		Unixtime: time.Now().Unix(),
+		Text:     text,
+	}}
+}
+
+// received reports whether the user has got message containing s
+func (f *fakeTelegram) received(userID int64, s string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, text := range f.messages[userID] {
+		if strings.Contains(text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeGAS is GAS web app which records merchants of uploaded purchases and report commands
+type fakeGAS struct {
+	*httptest.Server
+	hold      chan struct{} // Requests wait for it if it's set
+	mu        sync.Mutex
+	merchants []string
+	commands  []string
+}
+
+func newFakeGAS(t *testing.T, hold chan struct{}) *fakeGAS {
+	g := &fakeGAS{hold: hold}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g.hold != nil {
+			select {
+			case <-g.hold:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if r.Method == http.MethodPost {
+			r.ParseForm()
+			g.merchants = append(g.merchants, r.PostForm.Get("merchant"))
+			fmt.Fprintf(w, `{"status": 0, "message": "row %d"}`, len(g.merchants))
+			return
+		}
+		g.commands = append(g.commands, r.URL.Query().Get("command"))
+		fmt.Fprint(w, `{"status": 0, "message": "GAS report"}`)
+	}))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *fakeGAS) uploaded() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.merchants...)
+}
+
+func (g *fakeGAS) requested() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.commands...)
+}
+
+// startBot runs the bot until the test is finished
+func startBot(t *testing.T, api *fakeTelegram, opts ...telegram.BotOption) (context.CancelFunc, <-chan struct{}) {
+	bot, err := telegram.NewBot("token", append([]telegram.BotOption{telegram.WithAPIURL(api.URL)}, opts...)...)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		bot.Start(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return cancel, stopped
+}
+
+func TestTenantRouting(t *testing.T) {
+	api := newFakeTelegram(t)
+	defaultGAS, userGAS := newFakeGAS(t, nil), newFakeGAS(t, nil)
+	startBot(t, api,
+		telegram.WithACL(map[int64]acl.Role{1: acl.ADMIN, 2: acl.WRITER}),
+		telegram.WithGAS(defaultGAS.URL, "", "id", "secret"))
+	eventually := func(f func() bool, msg string) {
+		assert.Eventually(t, f, 5*time.Second, 10*time.Millisecond, msg)
+	}
+
+	api.send(1, "/register 2 "+userGAS.URL)
+	eventually(func() bool { return api.received(1, "User 2 is registered") }, "User should be registered")
+
+	api.send(2, "Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽")
+	api.send(1, "Покупка 100 ₽, Лента.\nКарта **1111. Баланс: 4406,85 ₽")
+	eventually(func() bool { return len(userGAS.uploaded()) == 1 && len(defaultGAS.uploaded()) == 1 }, "Purchases should be uploaded")
+	assert.Equal(t, []string{"Озон"}, userGAS.uploaded(), "Registered user's purchase should go to own GAS")
+	assert.Equal(t, []string{"Лента"}, defaultGAS.uploaded())
+
+	api.send(2, "/stats")
+	eventually(func() bool { return api.received(2, "Total          1       527.11") }, "Stats should be of user's tenant")
+	api.send(2, "/today")
+	eventually(func() bool { return api.received(2, "GAS report") }, "Report should be requested")
+	assert.Equal(t, []string{"today"}, userGAS.requested())
+	assert.Empty(t, defaultGAS.requested())
+
+	api.send(1, "/unregister 2")
+	eventually(func() bool { return api.received(1, "User 2 is unregistered") }, "User should be unregistered")
+	api.send(2, "Покупка 200 ₽, Магнит.\nКарта **1111. Баланс: 4206,85 ₽")
+	eventually(func() bool { return len(defaultGAS.uploaded()) == 2 }, "Unregistered user's purchase should go to default GAS")
+	assert.Equal(t, []string{"Озон"}, userGAS.uploaded())
+}
+
+func TestShutdown(t *testing.T) {
+	purchase := "Покупка 527,11 ₽, Озон.\nКарта **1111. Баланс: 4506,85 ₽"
+	queued := func(api *fakeTelegram) func() bool {
+		return func() bool { return api.received(1, "Queued for upload") }
+	}
+
+	// Uploads in progress are waited for
+	api := newFakeTelegram(t)
+	hold := make(chan struct{})
+	g := newFakeGAS(t, hold)
+	stop, stopped := startBot(t, api,
+		telegram.WithACL(map[int64]acl.Role{1: acl.WRITER}),
+		telegram.WithGAS(g.URL, "", "id", "secret"),
+		telegram.WithShutdownTimeout(5*time.Second))
+	api.send(1, purchase)
+	assert.Eventually(t, queued(api), time.Second, time.Millisecond)
+	stop()
+	time.AfterFunc(100*time.Millisecond, func() { close(hold) })
+	<-stopped
+	assert.Equal(t, []string{"Озон"}, g.uploaded(), "Upload should be finished before exit")
+	api.mu.Lock()
+	assert.Equal(t, 2, len(api.messages[1]), "Reply should be edited with upload result only")
+	assert.Contains(t, api.messages[1][1], "Uploaded: row 1")
+	api.mu.Unlock()
+
+	// Handlers in progress are waited for, purchase is added while the bot waits for reply to be sent
+	api = newFakeTelegram(t)
+	api.delay = 200 * time.Millisecond
+	g = newFakeGAS(t, nil)
+	stop, stopped = startBot(t, api,
+		telegram.WithACL(map[int64]acl.Role{1: acl.WRITER}),
+		telegram.WithGAS(g.URL, "", "id", "secret"),
+		telegram.WithShutdownTimeout(5*time.Second))
+	api.send(1, purchase)
+	assert.Eventually(t, queued(api), time.Second, time.Millisecond)
+	stop()
+	<-stopped
+	assert.Equal(t, []string{"Озон"}, g.uploaded(), "Purchase should be uploaded by handler in progress")
+
+	// Uploads which are not finished in time are queued to outbox
+	dir := t.TempDir()
+	api = newFakeTelegram(t)
+	hold = make(chan struct{})
+	g = newFakeGAS(t, hold)
+	t.Cleanup(func() { close(hold) })
+	stop, stopped = startBot(t, api,
+		telegram.WithACL(map[int64]acl.Role{1: acl.WRITER}),
+		telegram.WithGAS(g.URL, "", "id", "secret"),
+		telegram.WithDataDir(dir),
+		telegram.WithShutdownTimeout(100*time.Millisecond))
+	api.send(1, purchase)
+	assert.Eventually(t, queued(api), time.Second, time.Millisecond)
+	stop()
+	<-stopped
+	o, err := outbox.New(filepath.Join(dir, "outbox.json"))
+	assert.Nil(t, err)
+	items := o.List()
+	assert.Equal(t, 1, len(items), "Purchase should be queued for retry after restart")
+	assert.Equal(t, "Озон", items[0].Purchase.Merchant)
+	h, err := history.New(filepath.Join(dir, "history.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(h.List()), "Purchase should be recorded")
+}
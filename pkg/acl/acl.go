@@ -0,0 +1,170 @@
+package acl
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dddpaul/alfafin-bot/pkg/storage"
+)
+
+// Role grants access to bot features, every role includes the previous ones
+type Role int64
+
+const (
+	NONE Role = iota
+	READER
+	WRITER
+	ADMIN
+)
+
+var roleNames = map[Role]string{NONE: "none", READER: "reader", WRITER: "writer", ADMIN: "admin"}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("role %d", r)
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+func ParseRole(s string) (Role, error) {
+	for k, v := range roleNames {
+		if k != NONE && v == strings.ToLower(s) {
+			return k, nil
+		}
+	}
+	return NONE, fmt.Errorf("unknown role %q, use reader, writer or admin", s)
+}
+
+// ACL is an allow-list of Telegram user IDs with their roles. Empty ACL denies everything to everyone.
+type ACL struct {
+	mu    sync.Mutex
+	path  string
+	Users map[int64]Role `json:"users"`
+}
+
+// New returns ACL persisted to the file at specified path or kept in memory if path is empty.
+// Initial roles seed the ACL only when persisted one is missing or empty, so roles granted and revoked
+// at runtime are never undone on restart.
+func New(path string, initial map[int64]Role) (*ACL, error) {
+	a := &ACL{path: path, Users: make(map[int64]Role)}
+	if path != "" {
+		if err := storage.Load(path, a); err != nil {
+			return nil, err
+		}
+		if a.Users == nil {
+			a.Users = make(map[int64]Role)
+		}
+	}
+	if len(a.Users) > 0 {
+		return a, nil
+	}
+	for id, role := range initial {
+		a.Users[id] = role
+	}
+	return a, a.save()
+}
+
+// ParseUsers parses comma separated list of "<user id>:<role>" pairs, role is writer if omitted
+func ParseUsers(s string) (map[int64]Role, error) {
+	users := make(map[int64]Role)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		idStr, roleStr, found := strings.Cut(item, ":")
+		id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user id %q", idStr)
+		}
+		role := WRITER
+		if found {
+			if role, err = ParseRole(strings.TrimSpace(roleStr)); err != nil {
+				return nil, err
+			}
+		}
+		users[id] = role
+	}
+	return users, nil
+}
+
+// IsEmpty reports whether no user is configured
+func (a *ACL) IsEmpty() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.Users) == 0
+}
+
+// Allowed reports whether user has the required role or higher
+func (a *ACL) Allowed(id int64, required Role) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	role, ok := a.Users[id]
+	return ok && role >= required
+}
+
+func (a *ACL) Grant(id int64, role Role) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Users[id] = role
+	return a.save()
+}
+
+// Revoke removes user from ACL, returns false if user was not there
+func (a *ACL) Revoke(id int64) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.Users[id]; !ok {
+		return false, nil
+	}
+	delete(a.Users, id)
+	return true, a.save()
+}
+
+// Admins returns IDs of users with admin role
+func (a *ACL) Admins() []int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ids []int64
+	for id, role := range a.Users {
+		if role == ADMIN {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// List returns copy of all users and roles
+func (a *ACL) List() map[int64]Role {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	users := make(map[int64]Role, len(a.Users))
+	for id, role := range a.Users {
+		users[id] = role
+	}
+	return users
+}
+
+func (a *ACL) save() error {
+	if a.path == "" {
+		return nil
+	}
+	return storage.Save(a.path, a)
+}
@@ -0,0 +1,106 @@
+package budget
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dddpaul/alfafin-bot/pkg/purchases"
+	"github.com/dddpaul/alfafin-bot/pkg/stats"
+)
+
+// TOTAL is the name of the overall budget, other budgets are named after categories
+const TOTAL = "total"
+
+// THRESHOLDS are budget shares which trigger alert when reached
+var THRESHOLDS = []float64{0.8, 1.0}
+
+// Budgets are monthly limits in roubles by category name or TOTAL
+type Budgets map[string]float64
+
+// Parse parses comma separated list of "<category or total>=<limit>" pairs
+func Parse(s string) (Budgets, error) {
+	b := make(Budgets)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, limitStr, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid budget %q, use <category>=<limit>", item)
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(limitStr), 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid budget limit %q", limitStr)
+		}
+		b[strings.TrimSpace(name)] = limit
+	}
+	return b, nil
+}
+
+type Status struct {
+	Name  string
+	Limit float64
+	Spent float64
+}
+
+func (s Status) Remaining() float64 {
+	return s.Limit - s.Spent
+}
+
+func (s Status) String() string {
+	return fmt.Sprintf("%s: spent %.2f of %.2f ₽ (%.0f%%), remaining %.2f ₽", s.Name, s.Spent, s.Limit, s.Spent/s.Limit*100, s.Remaining())
+}
+
+// Status returns spent vs. limit of every budget for the month, total goes first
+func (b Budgets) Status(pp []*purchases.Purchase, month stats.Period) []Status {
+	spent := make(map[string]float64)
+	for _, t := range stats.GroupBy(pp, month, stats.ByCategory) {
+		spent[t.Name] = t.SumRUB
+		spent[TOTAL] += t.SumRUB
+	}
+	names := make([]string, 0, len(b))
+	for name := range b {
+		if name != TOTAL {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	if _, ok := b[TOTAL]; ok {
+		names = append([]string{TOTAL}, names...)
+	}
+	ss := make([]Status, 0, len(names))
+	for _, name := range names {
+		ss = append(ss, Status{Name: name, Limit: b[name], Spent: spent[name]})
+	}
+	return ss
+}
+
+// Alerts returns warnings for the budgets which reached threshold because of purchase p.
+// Recorded purchases pp have to include p already.
+func (b Budgets) Alerts(pp []*purchases.Purchase, p *purchases.Purchase) []string {
+	if p.IsIncome() || p.PriceRUB <= 0 {
+		return nil
+	}
+	month, err := stats.NewPeriod("month", p.Time)
+	if err != nil {
+		return nil
+	}
+	var alerts []string
+	for _, s := range b.Status(pp, month) {
+		if s.Name != TOTAL && s.Name != stats.ByCategory(p) {
+			continue
+		}
+		before := s.Spent - p.PriceRUB
+		for i := len(THRESHOLDS) - 1; i >= 0; i-- {
+			t := THRESHOLDS[i]
+			if before < t*s.Limit && s.Spent >= t*s.Limit {
+				alerts = append(alerts, fmt.Sprintf("Budget %s for %s reached %.0f%%\n%s", s.Name, month.From.Format("01.2006"), t*100, s))
+				break
+			}
+		}
+	}
+	return alerts
+}
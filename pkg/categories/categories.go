@@ -0,0 +1,147 @@
+package categories
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/dddpaul/alfafin-bot/pkg/storage"
+)
+
+// Supported rule types
+const (
+	EXACT  = "exact"
+	PREFIX = "prefix"
+	REGEX  = "regex"
+)
+
+// Rule assigns category to the merchant. Exact and prefix rules are case-insensitive, regex may use (?i) flag.
+type Rule struct {
+	Match    string `yaml:"match" json:"match"`
+	Pattern  string `yaml:"pattern" json:"pattern"`
+	Category string `yaml:"category" json:"category"`
+
+	re *regexp.Regexp
+}
+
+func (r *Rule) compile() error {
+	switch r.Match {
+	case "", EXACT:
+		r.Match = EXACT
+	case PREFIX:
+	case REGEX:
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	default:
+		return fmt.Errorf("unknown match type %q, use exact, prefix or regex", r.Match)
+	}
+	if r.Category == "" {
+		return fmt.Errorf("rule %q has empty category", r.Pattern)
+	}
+	return nil
+}
+
+func (r *Rule) matches(merchant string) bool {
+	switch r.Match {
+	case EXACT:
+		return strings.EqualFold(merchant, r.Pattern)
+	case PREFIX:
+		return strings.HasPrefix(strings.ToLower(merchant), strings.ToLower(r.Pattern))
+	case REGEX:
+		return r.re.MatchString(merchant)
+	}
+	return false
+}
+
+// Rules categorises merchants. Rules set from Telegram are persisted separately and take precedence
+// over rules loaded from file, otherwise the first matching rule wins.
+type Rules struct {
+	mu        sync.RWMutex
+	path      string
+	fileRules []*Rule
+	UserRules []*Rule `json:"rules"`
+}
+
+// New returns rules loaded from YAML or JSON file (if specified) and persisted user rules (if path is specified)
+func New(file string, path string) (*Rules, error) {
+	r := &Rules{path: path}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var f struct {
+			Rules []*Rule `yaml:"rules"`
+		}
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		r.fileRules = f.Rules
+	}
+	if path != "" {
+		if err := storage.Load(path, r); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range slices.Concat(r.UserRules, r.fileRules) {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Categorize returns category of the merchant or empty string if no rule matches
+func (r *Rules) Categorize(merchant string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rule := range slices.Concat(r.UserRules, r.fileRules) {
+		if rule.matches(merchant) {
+			return rule.Category
+		}
+	}
+	return ""
+}
+
+// Set adds or replaces exact rule for the merchant
+func (r *Rules) Set(merchant string, category string) error {
+	rule := &Rule{Match: EXACT, Pattern: merchant, Category: category}
+	if err := rule.compile(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.UserRules, func(rule *Rule) bool { return strings.EqualFold(rule.Pattern, merchant) })
+	if i >= 0 {
+		r.UserRules[i] = rule
+	} else {
+		r.UserRules = append(r.UserRules, rule)
+	}
+	return r.save()
+}
+
+// List returns copy of user rules
+func (r *Rules) List() []Rule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rules := make([]Rule, 0, len(r.UserRules))
+	for _, rule := range r.UserRules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+func (r *Rules) save() error {
+	if r.path == "" {
+		return nil
+	}
+	return storage.Save(r.path, r)
+}
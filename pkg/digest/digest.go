@@ -0,0 +1,114 @@
+package digest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dddpaul/alfafin-bot/pkg/stats"
+)
+
+// Kinds of digests, each one summarizes the previous period of the respective report
+const (
+	DAILY   = "daily"   // yesterday, sent every day
+	WEEKLY  = "weekly"  // previous week, sent on Mondays
+	MONTHLY = "monthly" // previous month, sent on the 1st day of month
+)
+
+// Digest is a summary sent periodically at the specified time of day in local timezone
+type Digest struct {
+	Kind   string
+	Hour   int
+	Minute int
+}
+
+// Sender delivers digest of the period
+type Sender func(ctx context.Context, d Digest, p stats.Period)
+
+// Parse parses comma separated list of "<daily|weekly|monthly>=15:04" pairs
+func Parse(s string) ([]Digest, error) {
+	var dd []Digest
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kind, at, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid digest %q, use <daily|weekly|monthly>=15:04", item)
+		}
+		kind = strings.TrimSpace(kind)
+		if kind != DAILY && kind != WEEKLY && kind != MONTHLY {
+			return nil, fmt.Errorf("unknown digest %q", kind)
+		}
+		t, err := time.Parse("15:04", strings.TrimSpace(at))
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest time %q, use 15:04", at)
+		}
+		dd = append(dd, Digest{Kind: kind, Hour: t.Hour(), Minute: t.Minute()})
+	}
+	return dd, nil
+}
+
+func (d Digest) String() string {
+	return fmt.Sprintf("%s at %02d:%02d", d.Kind, d.Hour, d.Minute)
+}
+
+// Next returns the moment of the next digest after now
+func (d Digest) Next(now time.Time) time.Time {
+	at := time.Date(now.Year(), now.Month(), now.Day(), d.Hour, d.Minute, 0, 0, now.Location())
+	switch d.Kind {
+	case WEEKLY:
+		at = at.AddDate(0, 0, -(int(at.Weekday())+6)%7)
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 7)
+		}
+	case MONTHLY:
+		at = at.AddDate(0, 0, 1-at.Day())
+		if !at.After(now) {
+			at = at.AddDate(0, 1, 0)
+		}
+	default:
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+	}
+	return at
+}
+
+// Period returns the period summarized by digest sent at the specified moment
+func (d Digest) Period(at time.Time) (stats.Period, error) {
+	switch d.Kind {
+	case WEEKLY:
+		return stats.ParsePeriod("week", "-1", at)
+	case MONTHLY:
+		return stats.ParsePeriod("month", "-1", at)
+	}
+	return stats.ParsePeriod("today", "-1", at)
+}
+
+// Run sends digests on schedule until context is cancelled
+func Run(ctx context.Context, dd []Digest, send Sender) {
+	for _, d := range dd {
+		go d.run(ctx, send)
+	}
+}
+
+func (d Digest) run(ctx context.Context, send Sender) {
+	for {
+		at := d.Next(time.Now())
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		p, err := d.Period(at)
+		if err != nil {
+			continue
+		}
+		send(ctx, d, p)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -21,13 +22,38 @@ import (
 
 const MAX_RETRIES = 5
 
+// BATCH_SIZE is the default number of purchases uploaded by a single request, batches are disabled
+// since GAS web app has to support them
+const BATCH_SIZE = 1
+
+// MAX_BATCH_SIZE limits the number of purchases uploaded by a single AddBatch call. GAS execution time is limited
+// to 6 minutes, so the batch of 10 purchases fits into it even if each of them takes 25 seconds like single Add does.
+const MAX_BATCH_SIZE = 10
+
 type Client struct {
 	url    *url.URL
 	trace  *httptrace.ClientTrace
 	client *http.Client
 	rl     *rate.Limiter
+	retry  RetryPolicy
+	single atomic.Bool // GAS web app doesn't support batches
 }
 
+type ClientOption func(c *Client)
+
+// WithRetryPolicy replaces DefaultRetryPolicy of Add, AddBatch and Get
+func WithRetryPolicy(p RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// Content types of request body
+const (
+	FORM = "application/x-www-form-urlencoded"
+	JSON = "application/json"
+)
+
 type Status int64
 
 const (
@@ -37,8 +63,16 @@ const (
 )
 
 type Response struct {
-	Status  Status `json:"status"`
-	Message string `json:"message"`
+	Status  Status     `json:"status"`
+	Message string     `json:"message"`
+	ID      string     `json:"id,omitempty"`      // Purchase ID of batch result
+	Results []Response `json:"results,omitempty"` // Batch results
+}
+
+// Result is the outcome of a single purchase of the batch
+type Result struct {
+	Message string
+	Err     error
 }
 
 func (r *Response) isError() bool {
@@ -54,103 +88,216 @@ func (r *Response) isTemporalError() bool {
 // Simultaneous executions = 30 / user
 // Longest Add operation on server side = 25 seconds (from observing)
 // So our rate limit is 30/25 ~ 1 rps
-func NewClient(u string, socks string, id string, secret string) *Client {
+func NewClient(u string, socks string, id string, secret string, opts ...ClientOption) (*Client, error) {
 	u1, err := url.Parse(u)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid GAS URL: %w", err)
 	}
 	params := url.Values{}
 	params.Add("client_id", id)
 	params.Add("client_secret", secret)
 	u1.RawQuery = params.Encode()
 
-	return &Client{
+	c := &Client{
 		url:   u1,
 		trace: nil,
 		client: &http.Client{
 			Transport:     proxy.NewTransport(socks),
 			CheckRedirect: logger.LogRedirect,
 		},
-		rl: rate.NewLimiter(rate.Every(1*time.Second), 1),
+		rl:    rate.NewLimiter(rate.Every(1*time.Second), 1),
+		retry: DefaultRetryPolicy(),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c, nil
 }
 
 func (c *Client) Add(ctx context.Context, p *purchases.Purchase) (string, error) {
-	params := url.Values{}
-	params.Add("time", p.Time.Format(time.RFC3339))
-	params.Add("merchant", p.Merchant)
-	params.Add("price", strconv.FormatFloat(p.Price, 'f', 2, 64))
-	params.Add("currency", p.Currency)
-	params.Add("priceRUB", strconv.FormatFloat(p.PriceRUB, 'f', 2, 64))
+	params := purchaseParams(p)
 	logger.Log(ctx, nil).WithField("url", c.url.String()).WithField("body", fmt.Sprintf("%+v", params)).Debugf("request")
 
-	retry := 1
-	for retry <= MAX_RETRIES {
-		ctx = logger.WithRetryAttempt(ctx, retry)
-		req, err := http.NewRequestWithContext(
-			httptrace.WithClientTrace(ctx, logger.NewTrace(ctx)),
-			"POST",
-			c.url.String(),
-			strings.NewReader(params.Encode()))
-		if err != nil {
-			return "", err
+	r, err := c.send(ctx, "POST", c.url.String(), FORM, params.Encode())
+	if err != nil {
+		return "", err
+	}
+	return r.Message, nil
+}
+
+// AddBatch uploads purchases with a single request which body is JSON array of the same fields as Add has.
+// GAS web app replies with results of every purchase identified by id or listed in the same order.
+// Results are matched by position when the same purchase is repeated in the batch, e.g. added with /force.
+// Results are aligned with purchases, all of them hold the error if the whole request has failed.
+// When reply has no results, GAS web app is considered not supporting batches and purchases are uploaded one by one
+// with Add from then on.
+func (c *Client) AddBatch(ctx context.Context, pp []*purchases.Purchase) ([]Result, error) {
+	if c.single.Load() {
+		return c.addEach(ctx, pp), nil
+	}
+	results := make([]Result, len(pp))
+	index := make(map[string]int, len(pp))
+	repeated := false
+	items := make([]map[string]string, 0, len(pp))
+	for i, p := range pp {
+		if _, ok := index[p.ID()]; ok {
+			repeated = true
 		}
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		index[p.ID()] = i
+		item := map[string]string{}
+		for k, vv := range purchaseParams(p) {
+			item[k] = vv[0]
+		}
+		items = append(items, item)
+	}
+	body, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	logger.Log(ctx, nil).WithField("url", c.url.String()).WithField("body", string(body)).Debugf("request")
 
-		err = c.rl.Wait(ctx)
-		if err != nil {
-			return "", err
+	r, err := c.send(ctx, "POST", c.url.String(), JSON, string(body))
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results, err
+	}
+	if len(r.Results) == 0 {
+		logger.Log(ctx, nil).WithField("body", fmt.Sprintf("%+v", r)).Warnf("GAS web app doesn't support batches, purchases are uploaded one by one")
+		c.single.Store(true)
+		return c.addEach(ctx, pp), nil
+	}
+	received := make([]bool, len(pp))
+	for n, item := range r.Results {
+		i, ok := index[item.ID]
+		if !ok || repeated {
+			i = n
 		}
-		resp, err := c.client.Do(req)
-		if err != nil {
-			logger.Log(ctx, err).Errorf("error")
-			retry++
-			time.Sleep(5 * time.Second)
+		if i >= len(pp) {
 			continue
 		}
-
-		r := parse(ctx, resp)
-		logger.Log(ctx, nil).WithField("body", fmt.Sprintf("%+v", r)).Debugf("response")
-
-		if r.isError() {
-			err = fmt.Errorf("code %d", r.Status)
-			if r.isTemporalError() {
-				retry++
-				logger.Log(ctx, err).Errorf("Waiting for %d seconds till next retry attempt %d", 5, retry)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			return "", err
+		received[i] = true
+		results[i].Message = item.Message
+		if item.isError() {
+			results[i].Err = fmt.Errorf("code %d: %s", item.Status, item.Message)
 		}
+	}
+	for i := range results {
+		if !received[i] {
+			results[i].Err = fmt.Errorf("no result of purchase %s", pp[i].ID())
+		}
+	}
+	return results, nil
+}
 
-		return r.Message, nil
+func (c *Client) addEach(ctx context.Context, pp []*purchases.Purchase) []Result {
+	results := make([]Result, len(pp))
+	for i, p := range pp {
+		results[i].Message, results[i].Err = c.Add(ctx, p)
 	}
+	return results
+}
 
-	return "", fmt.Errorf("all %d retries to add purchase was failed", MAX_RETRIES)
+func purchaseParams(p *purchases.Purchase) url.Values {
+	params := url.Values{}
+	params.Add("id", p.ID())
+	params.Add("time", p.Time.Format(time.RFC3339))
+	params.Add("operation", p.Operation.String())
+	params.Add("merchant", p.Merchant)
+	params.Add("card", p.Card)
+	params.Add("category", p.Category)
+	params.Add("price", strconv.FormatFloat(p.Price, 'f', 2, 64))
+	params.Add("currency", p.Currency)
+	params.Add("currency_code", p.CurrencyCode)
+	params.Add("priceRUB", strconv.FormatFloat(p.PriceRUB, 'f', 2, 64))
+	if p.Balance != 0 {
+		params.Add("balance", strconv.FormatFloat(p.Balance, 'f', 2, 64))
+	}
+	if p.CancelOf != "" {
+		params.Add("original_id", p.CancelOf)
+	}
+	return params
+}
+
+// Close releases idle connections, client may be used afterwards still
+func (c *Client) Close() {
+	c.client.CloseIdleConnections()
 }
 
-func (c *Client) Get(ctx context.Context, command string) (string, error) {
+// Get executes report command, extra parameters (e.g. period bounds) are passed as is
+func (c *Client) Get(ctx context.Context, command string, extra url.Values) (string, error) {
 	params := url.Values{}
 	params.Add("command", command)
+	for k, vv := range extra {
+		for _, v := range vv {
+			params.Add(k, v)
+		}
+	}
 	u := c.url.String() + "&" + params.Encode()
 	logger.Log(ctx, nil).WithField("url", u).Debugf("request")
 
+	r, err := c.send(ctx, "GET", u, "", "")
+	if err != nil {
+		return "", err
+	}
+	return r.Message, nil
+}
+
+// send sends request with retries
+func (c *Client) send(ctx context.Context, method string, u string, contentType string, body string) (*Response, error) {
+	var r *Response
+	err := c.retry.Do(ctx, func(ctx context.Context, attempt int) error {
+		var err error
+		r, err = c.do(ctx, method, u, contentType, body)
+		return err
+	})
+	return r, err
+}
+
+// do sends a single request within rate limit. Network errors, HTTP 429 and 5xx and GAS TEMPORAL_ERROR are retryable.
+func (c *Client) do(ctx context.Context, method string, u string, contentType string, body string) (*Response, error) {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
 	req, err := http.NewRequestWithContext(
 		httptrace.WithClientTrace(ctx, logger.NewTrace(ctx)),
-		"GET",
+		method,
 		u,
-		nil)
+		reader)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
 
+	if err := c.rl.Wait(ctx); err != nil {
+		return nil, err
+	}
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return "", err
+		logger.Log(ctx, err).Errorf("error")
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, Retryable(err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		resp.Body.Close()
+		return nil, Retryable(fmt.Errorf("HTTP %s", resp.Status))
 	}
 
 	r := parse(ctx, resp)
-	return r.Message, nil
+	logger.Log(ctx, nil).WithField("body", fmt.Sprintf("%+v", r)).Debugf("response")
+	if r.isTemporalError() {
+		return nil, Retryable(fmt.Errorf("code %d: %s", r.Status, r.Message))
+	}
+	if r.isError() {
+		return nil, fmt.Errorf("code %d: %s", r.Status, r.Message)
+	}
+	return r, nil
 }
 
 // Parse HTTP response from Google App Script
@@ -0,0 +1,117 @@
+package gas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/dddpaul/alfafin-bot/pkg/logger"
+)
+
+// Clock is the source of time for RetryPolicy, it's replaced in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// RetryPolicy retries retryable errors with exponential backoff: InitialInterval, InitialInterval*Multiplier
+// and so on up to MaxInterval. Every delay is randomized by ±Jitter share of it, so clients don't retry
+// simultaneously. Retries stop after MaxAttempts or when the next attempt would start after MaxElapsed.
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64
+	MaxAttempts     int
+	MaxElapsed      time.Duration // Unlimited if zero
+	Clock           Clock         // Real clock if nil
+}
+
+// DefaultRetryPolicy makes MAX_RETRIES attempts within 2 minutes
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialInterval: 2 * time.Second,
+		MaxInterval:     30 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.2,
+		MaxAttempts:     MAX_RETRIES,
+		MaxElapsed:      2 * time.Minute,
+	}
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// Retryable marks error as temporary, e.g. network error, HTTP 429 or 5xx, GAS TEMPORAL_ERROR
+func Retryable(err error) error {
+	return &retryableError{err: err}
+}
+
+func IsRetryable(err error) bool {
+	var r *retryableError
+	return errors.As(err, &r)
+}
+
+// Backoff returns delay before the attempt following the specified one
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := float64(p.InitialInterval) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxInterval > 0 {
+		d = math.Min(d, float64(p.MaxInterval))
+	}
+	if p.Jitter > 0 {
+		d = d * (1 - p.Jitter + 2*p.Jitter*rand.Float64())
+	}
+	return time.Duration(d)
+}
+
+// Do calls f until it succeeds or returns error which is not retryable, attempts or time are exhausted
+// or context is done
+func (p RetryPolicy) Do(ctx context.Context, f func(ctx context.Context, attempt int) error) error {
+	clock := p.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	start := clock.Now()
+	for attempt := 1; ; attempt++ {
+		ctx := logger.WithRetryAttempt(ctx, attempt)
+		err := f(ctx, attempt)
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			return fmt.Errorf("all %d attempts failed: %w", attempt, err)
+		}
+		delay := p.Backoff(attempt)
+		if p.MaxElapsed > 0 && clock.Now().Add(delay).Sub(start) > p.MaxElapsed {
+			return fmt.Errorf("retry time %v is exceeded after %d attempts: %w", p.MaxElapsed, attempt, err)
+		}
+		logger.Log(ctx, err).Errorf("Waiting for %v till next retry attempt %d", delay.Round(time.Millisecond), attempt+1)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		case <-clock.After(delay):
+		}
+	}
+}
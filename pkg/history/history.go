@@ -0,0 +1,98 @@
+package history
+
+import (
+	"sync"
+
+	"github.com/dddpaul/alfafin-bot/pkg/purchases"
+	"github.com/dddpaul/alfafin-bot/pkg/storage"
+)
+
+// History keeps all recorded purchases, it's used to detect duplicates
+type History struct {
+	mu        sync.Mutex
+	path      string
+	ids       map[string]int
+	Purchases []*purchases.Purchase `json:"purchases"`
+}
+
+// New returns history persisted to the file at specified path or kept in memory if path is empty
+func New(path string) (*History, error) {
+	h := &History{path: path, ids: make(map[string]int)}
+	if path != "" {
+		if err := storage.Load(path, h); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range h.Purchases {
+		h.ids[p.ID()]++
+	}
+	return h, nil
+}
+
+// Contains reports whether purchase with the same ID was recorded already
+func (h *History) Contains(p *purchases.Purchase) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ids[p.ID()] > 0
+}
+
+// Add records purchase if it wasn't recorded before or force is set, returns false for skipped duplicate.
+// Check and record are atomic, so the same message forwarded twice in a batch is recorded once.
+// Cancel or refund is linked to the most recent matching purchase which is not reversed yet, see Purchase.CancelOf.
+func (h *History) Add(p *purchases.Purchase, force bool) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !force && h.ids[p.ID()] > 0 {
+		return false, nil
+	}
+	if p.Operation.IsNegative() && p.CancelOf == "" {
+		if original := h.findOriginal(p); original != nil {
+			p.CancelOf = original.ID()
+		}
+	}
+	h.Purchases = append(h.Purchases, p)
+	h.ids[p.ID()]++
+	return true, h.save()
+}
+
+// Get returns the most recent purchase with specified ID or nil if there is no such purchase
+func (h *History) Get(id string) *purchases.Purchase {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.Purchases) - 1; i >= 0; i-- {
+		if h.Purchases[i].ID() == id {
+			return h.Purchases[i]
+		}
+	}
+	return nil
+}
+
+func (h *History) findOriginal(cancel *purchases.Purchase) *purchases.Purchase {
+	cancelled := make(map[string]bool)
+	for _, p := range h.Purchases {
+		if p.CancelOf != "" {
+			cancelled[p.CancelOf] = true
+		}
+	}
+	var original *purchases.Purchase
+	for _, p := range h.Purchases {
+		if cancel.Reverses(p) && !cancelled[p.ID()] && (original == nil || !p.Time.Before(original.Time)) {
+			original = p
+		}
+	}
+	return original
+}
+
+// List returns snapshot of recorded purchases in the order they were added
+func (h *History) List() []*purchases.Purchase {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*purchases.Purchase(nil), h.Purchases...)
+}
+
+func (h *History) save() error {
+	if h.path == "" {
+		return nil
+	}
+	return storage.Save(h.path, h)
+}
@@ -12,6 +12,7 @@ import (
 
 const MESSAGE_ID = "message_id"
 const RETRY_ATTEMPT = "retry"
+const OUTBOX_ID = "outbox_id"
 
 func WithMessageID(id int) context.Context {
 	return context.WithValue(context.Background(), MESSAGE_ID, id)
@@ -21,6 +22,10 @@ func WithRetryAttempt(ctx context.Context, r int) context.Context {
 	return context.WithValue(ctx, RETRY_ATTEMPT, r)
 }
 
+func WithOutboxID(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, OUTBOX_ID, id)
+}
+
 func NewTrace(ctx context.Context) *httptrace.ClientTrace {
 	var start time.Time
 	return &httptrace.ClientTrace{
@@ -42,6 +47,9 @@ func Log(ctx context.Context, err error) *log.Entry {
 	if retry := ctx.Value(RETRY_ATTEMPT); retry != nil {
 		entry = entry.WithField(RETRY_ATTEMPT, retry)
 	}
+	if outboxID := ctx.Value(OUTBOX_ID); outboxID != nil {
+		entry = entry.WithField(OUTBOX_ID, outboxID)
+	}
 	return entry
 }
 
@@ -0,0 +1,233 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dddpaul/alfafin-bot/pkg/logger"
+	"github.com/dddpaul/alfafin-bot/pkg/purchases"
+	"github.com/dddpaul/alfafin-bot/pkg/storage"
+)
+
+const (
+	MAX_ATTEMPTS = 10
+	MIN_BACKOFF  = 1 * time.Minute
+	MAX_BACKOFF  = 6 * time.Hour
+)
+
+type Status int64
+
+const (
+	PENDING Status = iota
+	FAILED
+)
+
+func (s Status) String() string {
+	switch s {
+	case PENDING:
+		return "pending"
+	case FAILED:
+		return "failed"
+	}
+	return fmt.Sprintf("status %d", s)
+}
+
+type Item struct {
+	ID        int64               `json:"id"`
+	Purchase  *purchases.Purchase `json:"purchase"`
+	Status    Status              `json:"status"`
+	Attempts  int                 `json:"attempts"`
+	LastError string              `json:"last_error,omitempty"`
+	Created   time.Time           `json:"created"`
+	NextTry   time.Time           `json:"next_try"`
+	Reply     *Reply              `json:"reply,omitempty"`
+}
+
+// Reply identifies the message which reports upload status to the sender
+type Reply struct {
+	ChatID    int64 `json:"chat_id"`
+	MessageID int   `json:"message_id"`
+}
+
+// Sender delivers purchases to their final destination, returned errors are aligned with purchases
+type Sender func(ctx context.Context, pp []*purchases.Purchase) []error
+
+// Notifier is called when item is finally delivered or marked as failed
+type Notifier func(ctx context.Context, item Item, delivered bool)
+
+// Outbox keeps purchases which were not delivered to Google Apps Script.
+// Items are retried with exponential backoff and marked as failed after MAX_ATTEMPTS, failed items are kept
+// until they are explicitly retried, so nothing is lost silently.
+type Outbox struct {
+	mu     sync.Mutex
+	path   string
+	NextID int64   `json:"next_id"`
+	Items  []*Item `json:"items"`
+}
+
+// New returns outbox persisted to the file at specified path or kept in memory if path is empty
+func New(path string) (*Outbox, error) {
+	o := &Outbox{path: path, NextID: 1}
+	if path == "" {
+		return o, nil
+	}
+	if err := storage.Load(path, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Push stores purchase which delivery was failed with err, reply is optional
+func (o *Outbox) Push(p *purchases.Purchase, err error, reply *Reply) (*Item, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	item := &Item{
+		ID:        o.NextID,
+		Purchase:  p,
+		Status:    PENDING,
+		Attempts:  1,
+		LastError: err.Error(),
+		Created:   now,
+		NextTry:   now.Add(backoff(1)),
+		Reply:     reply,
+	}
+	o.NextID++
+	o.Items = append(o.Items, item)
+	return item, o.save()
+}
+
+// List returns snapshot of all items
+func (o *Outbox) List() []Item {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	items := make([]Item, 0, len(o.Items))
+	for _, item := range o.Items {
+		items = append(items, *item)
+	}
+	return items
+}
+
+// Retry makes failed items pending again and returns the number of affected items
+func (o *Outbox) Retry() (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for _, item := range o.Items {
+		if item.Status == FAILED {
+			item.Status = PENDING
+			item.Attempts = 0
+			item.NextTry = now
+			n++
+		}
+	}
+	return n, o.save()
+}
+
+// Run drains outbox every interval until ctx is done
+func (o *Outbox) Run(ctx context.Context, interval time.Duration, size int, send Sender, notify Notifier) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.Drain(ctx, size, send, notify)
+		}
+	}
+}
+
+// Drain tries to send all pending items which retry time has come, items are sent in batches of the specified size.
+// Notify is called for delivered and failed items if it's not nil.
+func (o *Outbox) Drain(ctx context.Context, size int, send Sender, notify Notifier) {
+	size = max(size, 1)
+	items := o.due(time.Now())
+	for len(items) > 0 {
+		if ctx.Err() != nil {
+			return
+		}
+		batch := items[:min(size, len(items))]
+		items = items[len(batch):]
+		pp := make([]*purchases.Purchase, 0, len(batch))
+		for _, item := range batch {
+			pp = append(pp, item.Purchase)
+		}
+		ctx1 := ctx
+		if len(batch) == 1 {
+			ctx1 = logger.WithOutboxID(ctx, batch[0].ID)
+		}
+		errs := send(ctx1, pp)
+		var delivered, failed []Item
+		o.mu.Lock()
+		for i, item := range batch {
+			ctx1 := logger.WithOutboxID(ctx, item.ID)
+			if err := errs[i]; err != nil {
+				item.Attempts++
+				item.LastError = err.Error()
+				item.NextTry = time.Now().Add(backoff(item.Attempts))
+				if item.Attempts >= MAX_ATTEMPTS {
+					item.Status = FAILED
+					failed = append(failed, *item)
+				}
+				logger.Log(ctx1, err).WithField("attempts", item.Attempts).WithField("status", item.Status).Errorf("outbox")
+			} else {
+				o.remove(item.ID)
+				delivered = append(delivered, *item)
+				logger.Log(ctx1, nil).Infof("outbox item is delivered")
+			}
+		}
+		if err := o.save(); err != nil {
+			logger.Log(ctx, err).Errorf("unable to save outbox")
+		}
+		o.mu.Unlock()
+		if notify != nil {
+			for _, item := range delivered {
+				notify(logger.WithOutboxID(ctx, item.ID), item, true)
+			}
+			for _, item := range failed {
+				notify(logger.WithOutboxID(ctx, item.ID), item, false)
+			}
+		}
+	}
+}
+
+func (o *Outbox) due(now time.Time) []*Item {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var items []*Item
+	for _, item := range o.Items {
+		if item.Status == PENDING && !item.NextTry.After(now) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (o *Outbox) remove(id int64) {
+	for i, item := range o.Items {
+		if item.ID == id {
+			o.Items = append(o.Items[:i], o.Items[i+1:]...)
+			return
+		}
+	}
+}
+
+func (o *Outbox) save() error {
+	if o.path == "" {
+		return nil
+	}
+	return storage.Save(o.path, o)
+}
+
+// backoff doubles delay after each attempt starting from MIN_BACKOFF up to MAX_BACKOFF
+func backoff(attempts int) time.Duration {
+	d := MIN_BACKOFF
+	for i := 1; i < attempts && d < MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	return min(d, MAX_BACKOFF)
+}
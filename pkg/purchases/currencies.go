@@ -0,0 +1,145 @@
+package purchases
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ISO_CODES are active ISO 4217 currency codes
+const ISO_CODES = "AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL BSD BTN BWP BYN BZD " +
+	"CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD " +
+	"HKD HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL LYD " +
+	"MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG " +
+	"QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD " +
+	"TZS UAH UGX USD UYU UZS VES VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL"
+
+// Currency is recognised in messages by ISO code, symbol or any of aliases, case-insensitive
+type Currency struct {
+	Code    string   `yaml:"code" json:"code"`
+	Symbol  string   `yaml:"symbol" json:"symbol"` // ISO code is used if empty
+	Aliases []string `yaml:"aliases" json:"aliases"`
+}
+
+type currenciesFile struct {
+	Currencies []Currency `yaml:"currencies" json:"currencies"`
+}
+
+var (
+	currenciesMu sync.RWMutex
+	currencies   map[string]*Currency // Keyed by upper-cased code, symbol and aliases
+)
+
+func init() {
+	SetCurrencies(DefaultCurrencies())
+}
+
+// DefaultCurrencies returns all ISO 4217 currencies with symbols of the popular ones and transliterated aliases
+// used by bank. The first currency wins when several ones share the same symbol.
+func DefaultCurrencies() []Currency {
+	known := []Currency{
+		{Code: "RUB", Symbol: "₽", Aliases: []string{"RUR", "руб", "руб.", "р.", "rub.", "rubl"}},
+		{Code: "USD", Symbol: "$", Aliases: []string{"US$", "долл", "долл.", "dollar"}},
+		{Code: "EUR", Symbol: "€", Aliases: []string{"евро", "evro", "euro"}},
+		{Code: "AMD", Symbol: "֏", Aliases: []string{"драм", "dram"}},
+		{Code: "BYN", Symbol: "Br", Aliases: []string{"BYR"}},
+		{Code: "GEL", Symbol: "₾", Aliases: []string{"лари", "lari"}},
+		{Code: "TRY", Symbol: "₺", Aliases: []string{"TL", "лира", "lira"}},
+		{Code: "KZT", Symbol: "₸", Aliases: []string{"тенге", "tenge"}},
+		{Code: "THB", Symbol: "฿", Aliases: []string{"бат", "baht"}},
+		{Code: "CNY", Symbol: "¥", Aliases: []string{"RMB", "юань", "yuan"}},
+		{Code: "GBP", Symbol: "£"},
+		{Code: "JPY", Symbol: "JP¥"},
+		{Code: "INR", Symbol: "₹"},
+		{Code: "KRW", Symbol: "₩"},
+		{Code: "UAH", Symbol: "₴"},
+		{Code: "ILS", Symbol: "₪"},
+		{Code: "VND", Symbol: "₫"},
+		{Code: "AED", Aliases: []string{"дирхам", "dirham"}},
+		{Code: "UZS", Aliases: []string{"сум", "sum"}},
+		{Code: "KGS", Aliases: []string{"сом", "som"}},
+	}
+	cc := known
+	for _, code := range strings.Fields(ISO_CODES) {
+		if findCurrency(known, code) < 0 {
+			cc = append(cc, Currency{Code: code, Symbol: code})
+		}
+	}
+	return cc
+}
+
+// SetCurrencies activates currencies
+func SetCurrencies(cc []Currency) {
+	index := make(map[string]*Currency)
+	for _, c := range cc {
+		c1 := c
+		if c1.Symbol == "" {
+			c1.Symbol = c1.Code
+		}
+		for _, key := range append([]string{c1.Code, c1.Symbol}, c1.Aliases...) {
+			key = strings.ToUpper(key)
+			if _, ok := index[key]; !ok {
+				index[key] = &c1
+			}
+		}
+	}
+	currenciesMu.Lock()
+	currencies = index
+	currenciesMu.Unlock()
+}
+
+// LoadCurrencies reads currencies from YAML or JSON file and activates them along with built-in ones.
+// Currency from file overrides symbol of the built-in one with the same code and extends its aliases.
+func LoadCurrencies(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f currenciesFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Currencies from file go first, so their symbols and aliases win
+	var cc []Currency
+	defaults := DefaultCurrencies()
+	for _, c := range f.Currencies {
+		if c.Code == "" {
+			return fmt.Errorf("%s: currency %q has empty code", path, c.Symbol)
+		}
+		c.Code = strings.ToUpper(c.Code)
+		if i := findCurrency(defaults, c.Code); i >= 0 {
+			if c.Symbol == "" {
+				c.Symbol = defaults[i].Symbol
+			}
+			c.Aliases = append(c.Aliases, defaults[i].Aliases...)
+			defaults = append(defaults[:i], defaults[i+1:]...)
+		}
+		cc = append(cc, c)
+	}
+	SetCurrencies(append(cc, defaults...))
+	return nil
+}
+
+// LookupCurrency returns currency by ISO code, symbol or alias
+func LookupCurrency(s string) (Currency, bool) {
+	currenciesMu.RLock()
+	defer currenciesMu.RUnlock()
+	c, ok := currencies[strings.ToUpper(strings.TrimSpace(s))]
+	if !ok {
+		return Currency{}, false
+	}
+	return *c, true
+}
+
+func findCurrency(cc []Currency, code string) int {
+	for i, c := range cc {
+		if c.Code == code {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,207 @@
+package purchases
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Names of rate providers
+const (
+	CBR_PROVIDER    = "cbr"
+	ECB_PROVIDER    = "ecb"
+	STATIC_PROVIDER = "static"
+)
+
+// ECB_URL is the full history of euro reference rates published by the European Central Bank
+const ECB_URL = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-hist.xml"
+
+// ECB_REFRESH is the interval of ECB feed downloads, the feed is updated once a day on working days
+const ECB_REFRESH = 24 * time.Hour
+
+// RatesConfig selects rate provider and adjusts its rates
+type RatesConfig struct {
+	Provider  string           `yaml:"provider" json:"provider"`   // cbr (default), ecb or static
+	ECBURL    string           `yaml:"ecb_url" json:"ecb_url"`     // ECB-style XML feed, ECB_URL by default
+	Static    Rates            `yaml:"static" json:"static"`       // Used for any date when provider has no rate of the currency
+	Overrides map[string]Rates `yaml:"overrides" json:"overrides"` // Keyed by date in 2006-01-02 format, take precedence over provider
+}
+
+// LoadRatesConfig reads config from YAML or JSON file, CBR provider is used if path is empty
+func LoadRatesConfig(path string) (*RatesConfig, error) {
+	c := &RatesConfig{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if c.Provider == "" {
+		c.Provider = CBR_PROVIDER
+	}
+	for day := range c.Overrides {
+		if _, err := time.Parse(time.DateOnly, day); err != nil {
+			return nil, fmt.Errorf("%s: invalid override date %q, use 2006-01-02", path, day)
+		}
+	}
+	return c, nil
+}
+
+// NewProvider returns provider selected by config. Static and overridden rates are applied by Wrap.
+func (c *RatesConfig) NewProvider() (RateProvider, error) {
+	switch c.Provider {
+	case CBR_PROVIDER:
+		return CBR{}, nil
+	case ECB_PROVIDER:
+		url := c.ECBURL
+		if url == "" {
+			url = ECB_URL
+		}
+		return NewECB(url, CBR{}), nil
+	case STATIC_PROVIDER:
+		return StaticRates{}, nil
+	}
+	return nil, fmt.Errorf("unknown rate provider %q", c.Provider)
+}
+
+// Wrap returns provider which fills rates missing in p with static ones and replaces rates of specific dates with overrides
+func (c *RatesConfig) Wrap(p RateProvider) RateProvider {
+	return &overriddenRates{provider: p, static: c.Static, overrides: c.Overrides}
+}
+
+// StaticRates are the same for any date
+type StaticRates Rates
+
+func (s StaticRates) Rates(dt time.Time) (Rates, error) {
+	return Rates(s), nil
+}
+
+type overriddenRates struct {
+	provider  RateProvider
+	static    Rates
+	overrides map[string]Rates
+}
+
+// Rates returns static and overridden rates along with provider error, so currencies known to config
+// are converted even when provider is unavailable
+func (o *overriddenRates) Rates(dt time.Time) (Rates, error) {
+	rates, err := o.provider.Rates(dt)
+	merged := make(Rates)
+	for _, rr := range []Rates{o.static, rates, o.overrides[dt.In(time.Local).Format(time.DateOnly)]} {
+		for code, rate := range rr {
+			merged[code] = rate
+		}
+	}
+	return merged, err
+}
+
+// ECB provides rates from ECB-style XML feed. Feed rates are given per 1 EUR, they are converted to roubles
+// with RUB rate from the feed if present or with EUR rate of the base provider otherwise.
+type ECB struct {
+	url     string
+	base    RateProvider
+	client  *http.Client
+	mu      sync.Mutex
+	feed    *ecbFeed // Parsed feed is kept in memory, it holds the whole history of rates
+	fetched time.Time
+}
+
+type ecbFeed struct {
+	Days []struct {
+		Time  string `xml:"time,attr"`
+		Rates []struct {
+			Currency string  `xml:"currency,attr"`
+			Rate     float64 `xml:"rate,attr"`
+		} `xml:"Cube"`
+	} `xml:"Cube>Cube"`
+}
+
+func NewECB(url string, base RateProvider) *ECB {
+	return &ECB{url: url, base: base, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Rates returns rates of the date or the latest date before it, feed has no rates on weekends and holidays
+func (e *ECB) Rates(dt time.Time) (Rates, error) {
+	feed, err := e.load()
+	if err != nil {
+		return nil, err
+	}
+
+	day := dt.In(time.Local).Format(time.DateOnly)
+	latest := -1
+	for i, d := range feed.Days {
+		if d.Time <= day && (latest < 0 || d.Time > feed.Days[latest].Time) {
+			latest = i
+		}
+	}
+	if latest < 0 {
+		return nil, fmt.Errorf("no ECB rates for %s", day)
+	}
+
+	perEUR := make(Rates)
+	for _, r := range feed.Days[latest].Rates {
+		perEUR[r.Currency] = r.Rate
+	}
+	eur, ok := perEUR["RUB"]
+	if !ok {
+		base, err := e.base.Rates(dt)
+		if err != nil {
+			return nil, err
+		}
+		if eur, ok = base["EUR"]; !ok {
+			return nil, fmt.Errorf("no EUR rate for %s", day)
+		}
+	}
+	rates := Rates{"EUR": eur}
+	for code, rate := range perEUR {
+		if rate != 0 && code != "RUB" {
+			rates[code] = eur / rate
+		}
+	}
+	return rates, nil
+}
+
+// load returns parsed feed downloading it at most once per ECB_REFRESH, previous feed is used if download fails
+func (e *ECB) load() (*ecbFeed, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.feed != nil && time.Since(e.fetched) < ECB_REFRESH {
+		return e.feed, nil
+	}
+	feed, err := e.fetch()
+	if err != nil {
+		if e.feed != nil {
+			log.Errorf("Unable to refresh ECB rates, previous ones are used: %v", err)
+			return e.feed, nil
+		}
+		return nil, err
+	}
+	e.feed = feed
+	e.fetched = time.Now()
+	return feed, nil
+}
+
+func (e *ECB) fetch() (*ecbFeed, error) {
+	resp, err := e.client.Get(e.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid ECB response: %s", resp.Status)
+	}
+	feed := &ecbFeed{}
+	if err := xml.NewDecoder(resp.Body).Decode(feed); err != nil {
+		return nil, err
+	}
+	return feed, nil
+}
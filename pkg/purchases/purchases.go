@@ -1,78 +1,109 @@
 package purchases
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"math"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
-
-	"slices"
-
-	"github.com/dddpaul/cbr-currency-go"
-	"github.com/natekfl/untemplate"
 )
 
+// DateLayout is the date format of manual template and command arguments
+const DateLayout = "02.01.2006"
+
 type Operation int64
 
 const (
 	Buy Operation = iota
 	Cancel
+	Refund
+	Income
 )
 
-var (
-	templates       []*untemplate.Untemplater
-	mdRegexp        = regexp.MustCompile(`^(.+) (\d{2}\.\d{2}\.\d{4} \d{2}:\d{2})`)
-	df              = "02.01.2006 15:04"
-	ddmmyyyy        = "02.01.2006"
-	digitsRegexp    = regexp.MustCompile(`\d+`)
-	currencySymbols = map[string]string{"RUB": "₽", "RUR": "₽", "₽": "₽", "USD": "$", "EUR": "€", "AMD": "֏", "BYN": "Br"}
-	roubleSymbols   = []string{"RUB", "RUR", "₽"}
-)
+var operationNames = map[Operation]string{Buy: "buy", Cancel: "cancel", Refund: "refund", Income: "income"}
 
-func init() {
-	templateStrings := []string{
-		"Покупка {price} {currency}, {merchant}. Карта {card}. Баланс: {balance} ₽",         // Alfabank template before 2023-08
-		"{card} Pokupka {price} {currency} Balans {balance} RUR {merchant_datetime}",        // Alfabank template after 2023-08
-		"Покупка {card}: {price} {currency} в {merchant} Баланс: {balance}",                 // Alfabank template after 2024-07
-		"{date} {price} {currency} - {merchant}",                                            // Custom template for adding purchases manually
-		"Отмена операции {price} {currency}, {merchant}. Карта {card}. Баланс: {balance} ₽", // Alfabank cancel template
+func (op Operation) String() string {
+	if name, ok := operationNames[op]; ok {
+		return name
 	}
+	return fmt.Sprintf("operation %d", op)
+}
 
-	for _, tmplStr := range templateStrings {
-		tmpl, err := untemplate.Create(tmplStr)
-		if err != nil {
-			panic(err)
+func (op Operation) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+func (op *Operation) UnmarshalText(text []byte) error {
+	for k, v := range operationNames {
+		if v == string(text) {
+			*op = k
+			return nil
 		}
-		templates = append(templates, tmpl)
 	}
+	return fmt.Errorf("unknown operation %q", text)
+}
 
-	cbr.UpdateCurrencyRates()
+// IsNegative reports whether operation decreases expenses
+func (op Operation) IsNegative() bool {
+	return op == Cancel || op == Refund
 }
 
+var (
+	mdRegexp     = regexp.MustCompile(`^(.+) (\d{2}\.\d{2}\.\d{4} \d{2}:\d{2})`)
+	df           = "02.01.2006 15:04"
+	ddmmyyyy     = DateLayout
+	digitsRegexp = regexp.MustCompile(`\d+`)
+	numberRegexp = regexp.MustCompile(`^[\d\s\x{00A0}.,]+`)
+)
+
 type Purchase struct {
-	Time     time.Time
-	Price    float64
-	Merchant string
-	Card     string
-	Currency string
-	PriceRUB float64
+	Time         time.Time
+	Operation    Operation
+	Price        float64
+	Merchant     string
+	Card         string
+	Currency     string // Currency symbol
+	CurrencyCode string // ISO 4217 code
+	PriceRUB     float64
+	Balance      float64 // Card balance after operation, zero if message doesn't contain it
+	Raw          string  // Original message text
+	CancelOf     string  // ID of the purchase reversed by cancel or refund
+	Category     string  // Merchant category, it's assigned by categories rules after parsing
+}
+
+// Reverses reports whether p is a cancel or refund of the original purchase
+func (p *Purchase) Reverses(original *Purchase) bool {
+	return p.Operation.IsNegative() && original.Operation == Buy &&
+		p.Merchant == original.Merchant && p.Card == original.Card &&
+		p.Currency == original.Currency && p.Price == -original.Price &&
+		!original.Time.After(p.Time)
+}
+
+// ID returns stable purchase identifier, the same message always produces the same ID
+func (p *Purchase) ID() string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%d|%s|%.2f|%s|%s|%s", p.Time.Unix(), p.Operation, p.Price, p.Currency, p.Merchant, p.Card)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// IsIncome reports whether purchase is actually an incoming transfer
+func (p *Purchase) IsIncome() bool {
+	return p.Operation == Income
 }
 
 func New(dt time.Time, s string) (*Purchase, error) {
 	s1 := strings.ReplaceAll(s, "\n", " ")
-	op := Buy
 
+	var tmpl *Template
 	var m map[string]string
-	var err error
+	err := fmt.Errorf("no templates")
 
-	for i, tmpl := range templates {
-		m, err = tmpl.Extract(s1)
+	for _, tmpl = range getTemplates() {
+		m, err = tmpl.untemplater.Extract(s1)
 		if err == nil {
-			if i == len(templates)-1 { // Last template is cancel
-				op = Cancel
-			}
 			break
 		}
 	}
@@ -80,18 +111,19 @@ func New(dt time.Time, s string) (*Purchase, error) {
 	if err != nil {
 		return nil, err
 	}
+	op := tmpl.Operation
 
 	price, err := parseFloat(m["price"])
 	if err != nil {
 		return nil, err
 	}
 	price = roundFloat(price, 2)
-	if op == Cancel {
+	if op.IsNegative() {
 		price = -price
 	}
 
 	if date, ok := m["date"]; ok {
-		dt, err = time.ParseInLocation(ddmmyyyy, date, time.Local)
+		dt, err = time.ParseInLocation(tmpl.DateLayout, date, time.Local)
 		if err != nil {
 			return nil, err
 		}
@@ -107,23 +139,27 @@ func New(dt time.Time, s string) (*Purchase, error) {
 	merchant = digitsRegexp.ReplaceAllString(merchant, "")
 	merchant = strings.Trim(merchant, " ")
 
-	currencySymbol, ok := currencySymbols[m["currency"]]
+	currency, ok := LookupCurrency(m["currency"])
 	if !ok {
 		return nil, fmt.Errorf("unknown currency %s", m["currency"])
 	}
 
-	priceRUB, err := calcRoublePrice(price, m["currency"], dt)
+	priceRUB, err := calcRoublePrice(price, currency.Code, dt)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Purchase{
-		Time:     dt,
-		Price:    price,
-		Merchant: merchant,
-		Card:     m["card"],
-		Currency: currencySymbol,
-		PriceRUB: priceRUB,
+		Time:         dt,
+		Operation:    op,
+		Price:        price,
+		Merchant:     merchant,
+		Card:         m["card"],
+		Currency:     currency.Symbol,
+		CurrencyCode: currency.Code,
+		PriceRUB:     priceRUB,
+		Balance:      parseBalance(m["balance"]),
+		Raw:          s,
 	}, nil
 }
 
@@ -134,6 +170,16 @@ func parseFloat(s string) (float64, error) {
 	return strconv.ParseFloat(s1, 64)
 }
 
+// parseBalance returns balance without currency, e.g. "17 403,67 RUR". Balance is optional, so it's zero if absent
+// or can't be parsed. Purchase must not be lost because of it.
+func parseBalance(s string) float64 {
+	balance, err := parseFloat(strings.TrimSpace(numberRegexp.FindString(strings.TrimSpace(s))))
+	if err != nil {
+		return 0
+	}
+	return roundFloat(balance, 2)
+}
+
 func parseMerchantAndDatetime(md string) (string, time.Time, error) {
 	tokens := mdRegexp.FindStringSubmatch(md)
 	if len(tokens) != 3 {
@@ -146,29 +192,21 @@ func parseMerchantAndDatetime(md string) (string, time.Time, error) {
 	return tokens[1], dt, nil
 }
 
-func calcRoublePrice(price float64, currency string, dt time.Time) (float64, error) {
-	if slices.Contains(roubleSymbols, currency) {
+func calcRoublePrice(price float64, code string, dt time.Time) (float64, error) {
+	if code == "RUB" {
 		return roundFloat(price, 2), nil
 	}
-	rates := cbr.GetCurrencyRates()
-	if truncateDay(time.Now()) != truncateDay(dt) {
-		var err error
-		rates, err = cbr.FetchCurrencyRates(dt)
-		if err != nil {
-			return 0, err
-		}
+	rates, err := getRateProvider().Rates(dt)
+	if rate, ok := rates[code]; ok {
+		return roundFloat(price*rate, 2), nil
 	}
-	if rate, ok := rates[currency]; ok {
-		return roundFloat(price*rate.Value, 2), nil
+	if err != nil {
+		return 0, err
 	}
-	return 0, fmt.Errorf("unknown currency: %s", currency)
+	return 0, fmt.Errorf("no exchange rate of %s", code)
 }
 
 func roundFloat(val float64, precision uint) float64 {
 	ratio := math.Pow(10, float64(precision))
 	return math.Round(val*ratio) / ratio
 }
-
-func truncateDay(dt time.Time) time.Time {
-	return dt.Truncate(time.Hour * 24)
-}
@@ -0,0 +1,121 @@
+package purchases
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dddpaul/cbr-currency-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dddpaul/alfafin-bot/pkg/storage"
+)
+
+// RATES_INTERVAL is how often today's rates are checked by RatesCache.Run
+const RATES_INTERVAL = 1 * time.Hour
+
+// Rates are exchange rates in roubles per unit of currency keyed by ISO code
+type Rates map[string]float64
+
+// RateProvider returns exchange rates for the date. Some rates may be returned along with error
+// when the rest of them are unavailable.
+type RateProvider interface {
+	Rates(dt time.Time) (Rates, error)
+}
+
+// CBR provides official rates of the Central Bank of Russia
+type CBR struct{}
+
+func (CBR) Rates(dt time.Time) (Rates, error) {
+	cbrRates, err := cbr.FetchCurrencyRates(dt)
+	if err != nil {
+		return nil, err
+	}
+	rates := make(Rates, len(cbrRates))
+	for code, rate := range cbrRates {
+		rates[code] = rate.Value
+	}
+	return rates, nil
+}
+
+// RatesCache keeps rates of the underlying provider by date, so rates of every date are fetched only once
+// even when a batch of old messages is forwarded.
+type RatesCache struct {
+	mu       sync.Mutex
+	path     string
+	provider RateProvider
+	Days     map[string]Rates `json:"days"` // Keyed by local date in 2006-01-02 format
+}
+
+var (
+	ratesMu      sync.RWMutex
+	rateProvider RateProvider
+)
+
+func init() {
+	rateProvider, _ = NewRatesCache("", CBR{})
+}
+
+// NewRatesCache returns cache persisted to the file at specified path or kept in memory if path is empty
+func NewRatesCache(path string, provider RateProvider) (*RatesCache, error) {
+	c := &RatesCache{path: path, provider: provider, Days: make(map[string]Rates)}
+	if err := storage.Load(path, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *RatesCache) Rates(dt time.Time) (Rates, error) {
+	day := dt.In(time.Local).Format(time.DateOnly)
+	c.mu.Lock()
+	rates, ok := c.Days[day]
+	c.mu.Unlock()
+	if ok {
+		return rates, nil
+	}
+
+	rates, err := c.provider.Rates(dt)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Days[day] = rates
+	if c.path != "" {
+		// Rates may be fetched again, so purchase must not be lost because of it
+		if err := storage.Save(c.path, c); err != nil {
+			log.Errorf("Unable to save exchange rates: %v", err)
+		}
+	}
+	return rates, nil
+}
+
+// Run fetches today's rates every interval until context is cancelled, so they are ready before the first purchase
+// of the day. Rates are fetched once a day actually, the rest of calls are served by cache.
+func (c *RatesCache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Rates(time.Now()); err != nil {
+			log.Errorf("Unable to fetch exchange rates: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetRateProvider replaces provider of exchange rates used to convert purchase prices to roubles
+func SetRateProvider(p RateProvider) {
+	ratesMu.Lock()
+	rateProvider = p
+	ratesMu.Unlock()
+}
+
+func getRateProvider() RateProvider {
+	ratesMu.RLock()
+	defer ratesMu.RUnlock()
+	return rateProvider
+}
@@ -0,0 +1,121 @@
+package purchases
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/natekfl/untemplate"
+	"gopkg.in/yaml.v3"
+)
+
+// Template describes how to extract purchase fields from the message text.
+// Pattern placeholders are: {price}, {currency}, {merchant}, {card}, {balance}, {date} and {merchant_datetime}.
+// Templates are tried in the order of descending priority, templates with equal priority keep their order.
+type Template struct {
+	Name       string    `yaml:"name" json:"name"`
+	Pattern    string    `yaml:"pattern" json:"pattern"`
+	Operation  Operation `yaml:"operation" json:"operation"`
+	DateLayout string    `yaml:"date_layout" json:"date_layout"` // Layout of {date} placeholder, 02.01.2006 by default
+	Priority   int       `yaml:"priority" json:"priority"`
+
+	untemplater *untemplate.Untemplater
+}
+
+type templatesFile struct {
+	Templates []Template `yaml:"templates" json:"templates"`
+}
+
+var (
+	templatesMu sync.RWMutex
+	templates   []*Template
+)
+
+func init() {
+	if err := SetTemplates(DefaultTemplates()); err != nil {
+		panic(err)
+	}
+}
+
+// DefaultTemplates returns built-in templates
+func DefaultTemplates() []Template {
+	return []Template{
+		{Name: "alfa-before-2023-08", Pattern: "Покупка {price} {currency}, {merchant}. Карта {card}. Баланс: {balance} ₽", Operation: Buy},
+		{Name: "alfa-2023-08", Pattern: "{card} Pokupka {price} {currency} Balans {balance} RUR {merchant_datetime}", Operation: Buy},
+		{Name: "alfa-2024-07", Pattern: "Покупка {card}: {price} {currency} в {merchant} Баланс: {balance}", Operation: Buy},
+		{Name: "manual", Pattern: "{date} {price} {currency} - {merchant}", Operation: Buy}, // For adding purchases manually
+		{Name: "alfa-cancel", Pattern: "Отмена операции {price} {currency}, {merchant}. Карта {card}. Баланс: {balance} ₽", Operation: Cancel},
+		{Name: "alfa-income", Pattern: "Деньги пришли! {price} {currency} на карту {card}. Баланс: {balance} ₽", Operation: Income},
+	}
+}
+
+// SetTemplates compiles and activates templates
+func SetTemplates(tt []Template) error {
+	compiled := make([]*Template, 0, len(tt))
+	for _, t := range tt {
+		t1 := t
+		u, err := untemplate.Create(t1.Pattern)
+		if err != nil {
+			return fmt.Errorf("template %q: %w", t1.Name, err)
+		}
+		t1.untemplater = u
+		if t1.DateLayout == "" {
+			t1.DateLayout = ddmmyyyy
+		}
+		compiled = append(compiled, &t1)
+	}
+	slices.SortStableFunc(compiled, func(a, b *Template) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+
+	templatesMu.Lock()
+	templates = compiled
+	templatesMu.Unlock()
+	return nil
+}
+
+// LoadTemplates reads templates from YAML or JSON file and activates them along with built-in ones.
+// Template from file replaces built-in one with the same name. Templates are kept intact on error.
+func LoadTemplates(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f templatesFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	tt := DefaultTemplates()
+	for _, t := range f.Templates {
+		if t.Pattern == "" {
+			return fmt.Errorf("%s: template %q has empty pattern", path, t.Name)
+		}
+		i := slices.IndexFunc(tt, func(t1 Template) bool { return t.Name != "" && t1.Name == t.Name })
+		if i >= 0 {
+			tt[i] = t
+		} else {
+			tt = append(tt, t)
+		}
+	}
+	return SetTemplates(tt)
+}
+
+// Templates returns active templates in the order they are tried
+func Templates() []Template {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	tt := make([]Template, 0, len(templates))
+	for _, t := range templates {
+		tt = append(tt, *t)
+	}
+	return tt
+}
+
+func getTemplates() []*Template {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	return templates
+}
@@ -0,0 +1,146 @@
+package stats
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dddpaul/alfafin-bot/pkg/purchases"
+)
+
+// Period is a half-open time interval [From, To)
+type Period struct {
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+// NewPeriod returns current period by its name: today, week, month or year. Week starts on Monday.
+func NewPeriod(name string, now time.Time) (Period, error) {
+	return ParsePeriod(name, "", now)
+}
+
+// ParsePeriod returns period by its name and optional argument:
+//
+//	today [-N | 02.01.2006]
+//	week [-N]
+//	month [-N | 2006-01 | 01.2006]
+//	year [-N | 2006]
+//	range 02.01.2006 [02.01.2006]
+//
+// where -N is the number of periods back from now. Range includes both dates, it ends today if the end is omitted.
+func ParsePeriod(name string, arg string, now time.Time) (Period, error) {
+	arg = strings.TrimSpace(arg)
+	day := truncateLocalDay(now)
+
+	offset := 0
+	if strings.HasPrefix(arg, "-") {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return Period{}, fmt.Errorf("invalid offset %q", arg)
+		}
+		offset, arg = n, ""
+	}
+
+	var from time.Time
+	var err error
+	switch name {
+	case "today":
+		from = day.AddDate(0, 0, offset)
+		if arg != "" {
+			from, err = time.ParseInLocation(purchases.DateLayout, arg, now.Location())
+		}
+		return newPeriod(name, from, from.AddDate(0, 0, 1), err)
+	case "week":
+		from = day.AddDate(0, 0, -(int(day.Weekday())+6)%7+7*offset)
+		if arg != "" {
+			err = fmt.Errorf("invalid week %q, use -N", arg)
+		}
+		return newPeriod(name, from, from.AddDate(0, 0, 7), err)
+	case "month":
+		from = time.Date(now.Year(), now.Month()+time.Month(offset), 1, 0, 0, 0, 0, now.Location())
+		if arg != "" {
+			from, err = time.ParseInLocation("2006-01", arg, now.Location())
+			if err != nil {
+				from, err = time.ParseInLocation("01.2006", arg, now.Location())
+			}
+		}
+		return newPeriod(name, from, from.AddDate(0, 1, 0), err)
+	case "year":
+		from = time.Date(now.Year()+offset, 1, 1, 0, 0, 0, 0, now.Location())
+		if arg != "" {
+			from, err = time.ParseInLocation("2006", arg, now.Location())
+		}
+		return newPeriod(name, from, from.AddDate(1, 0, 0), err)
+	case "range":
+		dates := strings.Fields(arg)
+		if offset != 0 || len(dates) < 1 || len(dates) > 2 {
+			return Period{}, fmt.Errorf("invalid range %q, use 02.01.2006 [02.01.2006]", arg)
+		}
+		from, err = time.ParseInLocation(purchases.DateLayout, dates[0], now.Location())
+		if err != nil {
+			return Period{}, err
+		}
+		to := day
+		if len(dates) == 2 {
+			if to, err = time.ParseInLocation(purchases.DateLayout, dates[1], now.Location()); err != nil {
+				return Period{}, err
+			}
+		}
+		if to.Before(from) {
+			return Period{}, fmt.Errorf("range end %s is before its start", dates[len(dates)-1])
+		}
+		return newPeriod(name, from, to.AddDate(0, 0, 1), nil)
+	}
+	return Period{}, fmt.Errorf("unknown period %q", name)
+}
+
+// IsPeriodName reports whether s is a name accepted by ParsePeriod
+func IsPeriodName(s string) bool {
+	switch s {
+	case "today", "week", "month", "year", "range":
+		return true
+	}
+	return false
+}
+
+func newPeriod(name string, from time.Time, to time.Time, err error) (Period, error) {
+	if err != nil {
+		return Period{}, err
+	}
+	return Period{Name: name, From: from, To: to}, nil
+}
+
+func (p Period) Contains(dt time.Time) bool {
+	return !dt.Before(p.From) && dt.Before(p.To)
+}
+
+func (p Period) String() string {
+	last := p.Last()
+	if p.From.Equal(last) {
+		return p.From.Format(purchases.DateLayout)
+	}
+	return p.From.Format(purchases.DateLayout) + " - " + last.Format(purchases.DateLayout)
+}
+
+// Previous returns the period of the same kind right before this one
+func (p Period) Previous() Period {
+	switch p.Name {
+	case "month":
+		return Period{Name: p.Name, From: p.From.AddDate(0, -1, 0), To: p.From}
+	case "year":
+		return Period{Name: p.Name, From: p.From.AddDate(-1, 0, 0), To: p.From}
+	}
+	days := int(p.To.Sub(p.From).Round(24*time.Hour) / (24 * time.Hour))
+	return Period{Name: p.Name, From: p.From.AddDate(0, 0, -days), To: p.From}
+}
+
+// Last returns the last day of the period
+func (p Period) Last() time.Time {
+	return p.To.AddDate(0, 0, -1)
+}
+
+func truncateLocalDay(dt time.Time) time.Time {
+	return time.Date(dt.Year(), dt.Month(), dt.Day(), 0, 0, 0, 0, dt.Location())
+}
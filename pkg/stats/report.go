@@ -0,0 +1,212 @@
+package stats
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dddpaul/alfafin-bot/pkg/purchases"
+)
+
+const TOP_MERCHANTS = 5
+
+type Total struct {
+	Name   string
+	Count  int64
+	Sum    float64 // Sum in original currency, it's used for currency totals only
+	SumRUB float64
+}
+
+// Key returns purchase attribute to group purchases by
+type Key func(p *purchases.Purchase) string
+
+var (
+	ByMerchant Key = func(p *purchases.Purchase) string { return orDash(p.Merchant) }
+	ByCard     Key = func(p *purchases.Purchase) string { return orDash(p.Card) }
+	ByCurrency Key = func(p *purchases.Purchase) string { return p.Currency }
+	ByCategory Key = func(p *purchases.Purchase) string { return orDash(p.Category) }
+)
+
+// Report summarizes purchases for the period. Incomes are not counted as expenses.
+type Report struct {
+	Period     Period
+	Count      int64
+	Sum        float64
+	Income     float64
+	Merchants  []Total // Sorted by descending sum
+	Categories []Total // Sorted by descending sum
+	Cards      []Total // Sorted by descending sum
+	Currencies []Total // Sorted by descending sum in roubles
+}
+
+func NewReport(pp []*purchases.Purchase, period Period) *Report {
+	r := &Report{Period: period}
+	for _, p := range pp {
+		if !period.Contains(p.Time) {
+			continue
+		}
+		if p.IsIncome() {
+			r.Income += p.PriceRUB
+			continue
+		}
+		r.Count++
+		r.Sum += p.PriceRUB
+	}
+	r.Merchants = GroupBy(pp, period, ByMerchant)
+	r.Categories = GroupBy(pp, period, ByCategory)
+	r.Cards = GroupBy(pp, period, ByCard)
+	r.Currencies = GroupBy(pp, period, ByCurrency)
+	return r
+}
+
+func (r *Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s: %d purchases, %.2f ₽", strings.ToUpper(r.Period.Name[:1])+r.Period.Name[1:], r.Period, r.Count, r.Sum)
+	if r.Income != 0 {
+		fmt.Fprintf(&sb, "\nIncome: %.2f ₽, net: %.2f ₽", r.Income, r.Income-r.Sum)
+	}
+	if len(r.Merchants) > 0 {
+		sb.WriteString("\nTop merchants:")
+		for _, t := range r.Merchants[:min(len(r.Merchants), TOP_MERCHANTS)] {
+			fmt.Fprintf(&sb, "\n  %s: %d, %.2f ₽", t.Name, t.Count, t.SumRUB)
+		}
+	}
+	if len(r.Categories) > 1 || len(r.Categories) == 1 && r.Categories[0].Name != "-" {
+		sb.WriteString("\nCategories:")
+		for _, t := range r.Categories {
+			fmt.Fprintf(&sb, "\n  %s: %d, %.2f ₽", t.Name, t.Count, t.SumRUB)
+		}
+	}
+	if len(r.Cards) > 1 {
+		sb.WriteString("\nCards:")
+		for _, t := range r.Cards {
+			fmt.Fprintf(&sb, "\n  %s: %d, %.2f ₽", t.Name, t.Count, t.SumRUB)
+		}
+	}
+	if len(r.Currencies) > 1 || len(r.Currencies) == 1 && r.Currencies[0].Name != "₽" {
+		sb.WriteString("\nCurrencies:")
+		for _, t := range r.Currencies {
+			fmt.Fprintf(&sb, "\n  %s: %d, %.2f %s", t.Name, t.Count, t.Sum, t.Name)
+			if t.Name != "₽" {
+				fmt.Fprintf(&sb, " (%.2f ₽)", t.SumRUB)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// GroupBy returns expense totals for the period grouped by key and sorted by descending sum in roubles
+func GroupBy(pp []*purchases.Purchase, period Period, key Key) []Total {
+	totals := make(map[string]*Total)
+	for _, p := range pp {
+		if period.Contains(p.Time) && !p.IsIncome() {
+			addTotal(totals, key(p), p.Price, p.PriceRUB)
+		}
+	}
+	return sortTotals(totals)
+}
+
+// Top returns top n merchants and categories for the period compared to the previous period
+func Top(pp []*purchases.Purchase, period Period, n int) string {
+	prev := period.Previous()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Top %d for %s %s, compared to %s", n, period.Name, period, prev)
+	for _, g := range []struct {
+		title string
+		key   Key
+	}{{"Merchants", ByMerchant}, {"Categories", ByCategory}, {"Cards", ByCard}} {
+		totals := GroupBy(pp, period, g.key)
+		if len(totals) == 0 || len(totals) == 1 && totals[0].Name == "-" {
+			continue
+		}
+		previous := make(map[string]float64)
+		for _, t := range GroupBy(pp, prev, g.key) {
+			previous[t.Name] = t.SumRUB
+		}
+		fmt.Fprintf(&sb, "\n%s:", g.title)
+		for _, t := range totals[:min(len(totals), n)] {
+			fmt.Fprintf(&sb, "\n  %s: %d, %.2f ₽ %s", t.Name, t.Count, t.SumRUB, formatChange(t.SumRUB, previous[t.Name]))
+		}
+	}
+	return sb.String()
+}
+
+// Merchant returns totals of the merchant for the period with the trend by days or by months for longer periods
+func Merchant(pp []*purchases.Purchase, period Period, merchant string) string {
+	var selected []*purchases.Purchase
+	for _, p := range pp {
+		if strings.EqualFold(p.Merchant, merchant) {
+			selected = append(selected, p)
+		}
+	}
+
+	// Bucket layout is sortable, label layout is human-readable
+	bucketLayout, labelLayout := time.DateOnly, purchases.DateLayout
+	if period.To.Sub(period.From) > 31*24*time.Hour {
+		bucketLayout, labelLayout = "2006-01", "01.2006"
+	}
+	trend := GroupBy(selected, period, func(p *purchases.Purchase) string { return p.Time.Format(bucketLayout) })
+	slices.SortFunc(trend, func(a, b Total) int { return cmp.Compare(a.Name, b.Name) })
+
+	var count int64
+	var sum float64
+	for _, t := range trend {
+		count += t.Count
+		sum += t.SumRUB
+	}
+	prev := period.Previous()
+	var prevSum float64
+	for _, t := range GroupBy(selected, prev, ByMerchant) {
+		prevSum += t.SumRUB
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s for %s %s: %d purchases, %.2f ₽ %s", merchant, period.Name, period, count, sum, formatChange(sum, prevSum))
+	for _, t := range trend {
+		dt, _ := time.Parse(bucketLayout, t.Name)
+		fmt.Fprintf(&sb, "\n  %s: %d, %.2f ₽", dt.Format(labelLayout), t.Count, t.SumRUB)
+	}
+	return sb.String()
+}
+
+// formatChange returns change relative to the previous value
+func formatChange(current float64, previous float64) string {
+	if previous == 0 {
+		return "(new)"
+	}
+	return fmt.Sprintf("(%+.0f%%)", (current-previous)/previous*100)
+}
+
+func addTotal(totals map[string]*Total, name string, sum float64, sumRUB float64) {
+	t, ok := totals[name]
+	if !ok {
+		t = &Total{Name: name}
+		totals[name] = t
+	}
+	t.Count++
+	t.Sum += sum
+	t.SumRUB += sumRUB
+}
+
+func sortTotals(totals map[string]*Total) []Total {
+	tt := make([]Total, 0, len(totals))
+	for _, t := range totals {
+		tt = append(tt, *t)
+	}
+	slices.SortFunc(tt, func(a, b Total) int {
+		if c := cmp.Compare(b.SumRUB, a.SumRUB); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return tt
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
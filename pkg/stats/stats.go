@@ -2,18 +2,27 @@ package stats
 
 import (
 	"encoding/json"
-	"github.com/dddpaul/alfafin-bot/pkg/purchases"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/dddpaul/alfafin-bot/pkg/purchases"
 )
 
+// MAX_DAYS limits the number of days in human-readable report to fit Telegram message size
+const MAX_DAYS = 31
+
 var (
 	mu sync.Mutex
 )
 
+// Expense is a daily summary. Count and Sum relate to expenses only, incoming transfers are summed up separately
 type Expense struct {
-	Count int64   `json:"count"`
-	Sum   float64 `json:"sum"`
+	Count  int64   `json:"count"`
+	Sum    float64 `json:"sum"`
+	Income float64 `json:"income,omitempty"`
 }
 
 // Expenses has Unix timestamp key instead of time.Time because of https://pkg.go.dev/time#Time:
@@ -24,22 +33,45 @@ type Expense struct {
 // been stripped by setting t = t.Round(0)
 type Expenses map[int64]Expense
 
+// MarshalJSON writes keys as dates in UTC since keys are UTC midnights made by truncateDay
 func (e Expenses) MarshalJSON() ([]byte, error) {
 	m := make(map[string]Expense)
 	for k, v := range e {
-		m[time.Unix(k, 0).Format(time.DateOnly)] = v
+		m[time.Unix(k, 0).UTC().Format(time.DateOnly)] = v
 	}
 	return json.Marshal(m)
 }
 
+// UnmarshalJSON is the reverse of MarshalJSON. Dates are parsed in UTC to get the same keys as truncateDay produces
+func (e *Expenses) UnmarshalJSON(data []byte) error {
+	m := make(map[string]Expense)
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	if *e == nil {
+		*e = NewExpenses()
+	}
+	for k, v := range m {
+		dt, err := time.Parse(time.DateOnly, k)
+		if err != nil {
+			return err
+		}
+		(*e)[dt.Unix()] = v
+	}
+	return nil
+}
+
 func (e Expenses) Add(p *purchases.Purchase) {
 	dt := truncateDay(p.Time).Unix()
 	mu.Lock()
-	if _, ok := e[dt]; ok {
-		e[dt] = Expense{Count: e[dt].Count + 1, Sum: e[dt].Sum + p.PriceRUB}
+	v := e[dt]
+	if p.IsIncome() {
+		v.Income = v.Income + p.PriceRUB
 	} else {
-		e[dt] = Expense{Count: 1, Sum: p.PriceRUB}
+		v.Count = v.Count + 1
+		v.Sum = v.Sum + p.PriceRUB
 	}
+	e[dt] = v
 	mu.Unlock()
 }
 
@@ -63,14 +95,29 @@ func (e Expenses) Sum() float64 {
 	return sum
 }
 
+func (e Expenses) Income() float64 {
+	var income float64 = 0
+	for _, v := range e {
+		income = income + v.Income
+	}
+	return income
+}
+
+// Net returns the balance of incomes and expenses
+func (e Expenses) Net() float64 {
+	return e.Income() - e.Sum()
+}
+
 type Stats struct {
 	Expenses Expenses `json:"expenses"`
 	Count    int64    `json:"count"`
 	Sum      float64  `json:"sum"`
+	Income   float64  `json:"income"`
+	Net      float64  `json:"net"`
 }
 
 func (e Expenses) Stats() (string, error) {
-	s := Stats{Expenses: e, Count: e.Count(), Sum: e.Sum()}
+	s := Stats{Expenses: e, Count: e.Count(), Sum: e.Sum(), Income: e.Income(), Net: e.Net()}
 	b, err := json.Marshal(s)
 	if err != nil {
 		return "", err
@@ -78,10 +125,81 @@ func (e Expenses) Stats() (string, error) {
 	return string(b), nil
 }
 
+// Format returns human-readable HTML report: table of the last MAX_DAYS days, totals, average and the biggest day
+func (e Expenses) Format() string {
+	e = e.snapshot()
+	if len(e) == 0 {
+		return "No expenses yet"
+	}
+	days := make([]int64, 0, len(e))
+	for k := range e {
+		days = append(days, k)
+	}
+	slices.Sort(days)
+
+	var sb strings.Builder
+	sb.WriteString("<pre>\n")
+	fmt.Fprintf(&sb, "%-10s %5s %12s\n", "Date", "Count", "Sum")
+	if len(days) > MAX_DAYS {
+		fmt.Fprintf(&sb, "...%d earlier days\n", len(days)-MAX_DAYS)
+	}
+	var biggest int64
+	for i, k := range days {
+		if i == 0 || e[k].Sum > e[biggest].Sum {
+			biggest = k
+		}
+		if i >= len(days)-MAX_DAYS {
+			fmt.Fprintf(&sb, "%-10s %5d %12.2f\n", formatDay(k), e[k].Count, e[k].Sum)
+		}
+	}
+	fmt.Fprintf(&sb, "%-10s %5d %12.2f\n", "Total", e.Count(), e.Sum())
+	sb.WriteString("</pre>\n")
+	fmt.Fprintf(&sb, "Average per day: %.2f ₽\n", e.Sum()/float64(len(days)))
+	fmt.Fprintf(&sb, "Biggest day: %s, %.2f ₽", formatDay(biggest), e[biggest].Sum)
+	if income := e.Income(); income != 0 {
+		fmt.Fprintf(&sb, "\nIncome: %.2f ₽, net: %.2f ₽", income, e.Net())
+	}
+	return sb.String()
+}
+
+// Filter returns expenses for the days within period
+func (e Expenses) Filter(p Period) Expenses {
+	e1 := NewExpenses()
+	for k, v := range e.snapshot() {
+		if p.Contains(localDay(k)) {
+			e1[k] = v
+		}
+	}
+	return e1
+}
+
+// snapshot copies expenses, so they may be read while handlers add new ones
+func (e Expenses) snapshot() Expenses {
+	mu.Lock()
+	defer mu.Unlock()
+	e1 := make(Expenses, len(e))
+	for k, v := range e {
+		e1[k] = v
+	}
+	return e1
+}
+
+func formatDay(k int64) string {
+	return time.Unix(k, 0).UTC().Format("02.01.2006")
+}
+
 func NewExpenses() Expenses {
 	return make(Expenses)
 }
 
+// truncateDay returns UTC midnight of the local date, so keys don't depend on the time zone
 func truncateDay(dt time.Time) time.Time {
-	return dt.Truncate(time.Hour * 24)
+	y, m, d := dt.In(time.Local).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// localDay returns local midnight of the key date to compare it with period bounds
+func localDay(k int64) time.Time {
+	y, m, d := time.Unix(k, 0).UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
 }
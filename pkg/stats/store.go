@@ -0,0 +1,75 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/dddpaul/alfafin-bot/pkg/storage"
+)
+
+// Store is a persistence layer for Expenses
+type Store interface {
+	Load() (Expenses, error)
+	Save(e Expenses) error
+}
+
+// NewStore returns file store if path is specified and in-memory store otherwise
+func NewStore(path string) Store {
+	if path == "" {
+		return &MemoryStore{}
+	}
+	return &FileStore{path: path}
+}
+
+// MemoryStore keeps nothing, so expenses are lost on restart
+type MemoryStore struct{}
+
+func (s *MemoryStore) Load() (Expenses, error) {
+	return NewExpenses(), nil
+}
+
+func (s *MemoryStore) Save(e Expenses) error {
+	return nil
+}
+
+// FileStore keeps expenses in JSON file in the same format as produced by Expenses.MarshalJSON.
+// Output of /stats command (Stats structure) is accepted as well, so it may be used to restore expenses
+// collected before persistence was introduced.
+type FileStore struct {
+	mu   sync.Mutex // Serializes saves, so an older snapshot never overwrites a newer one
+	path string
+}
+
+func (s *FileStore) Load() (Expenses, error) {
+	e := NewExpenses()
+	data, err := storage.ReadFile(s.path)
+	if err != nil || data == nil {
+		return e, err
+	}
+
+	var wrapped struct {
+		Expenses json.RawMessage `json:"expenses"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, err
+	}
+	if len(wrapped.Expenses) > 0 {
+		data = wrapped.Expenses
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (s *FileStore) Save(e Expenses) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mu.Lock()
+	data, err := e.MarshalJSON()
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return storage.WriteFile(s.path, data)
+}
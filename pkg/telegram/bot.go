@@ -3,27 +3,76 @@ package telegram
 import (
 	"context"
 	"fmt"
-	"github.com/dddpaul/alfafin-bot/pkg/stats"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/dddpaul/alfafin-bot/pkg/acl"
+	"github.com/dddpaul/alfafin-bot/pkg/budget"
+	"github.com/dddpaul/alfafin-bot/pkg/categories"
+	"github.com/dddpaul/alfafin-bot/pkg/digest"
 	"github.com/dddpaul/alfafin-bot/pkg/gas"
 	"github.com/dddpaul/alfafin-bot/pkg/logger"
+	"github.com/dddpaul/alfafin-bot/pkg/outbox"
 	"github.com/dddpaul/alfafin-bot/pkg/proxy"
 	"github.com/dddpaul/alfafin-bot/pkg/purchases"
+	"github.com/dddpaul/alfafin-bot/pkg/stats"
+	"github.com/dddpaul/alfafin-bot/pkg/uploads"
+	"github.com/dddpaul/alfafin-bot/pkg/users"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
 type Bot struct {
-	bot        *tb.Bot
-	admin      string
-	gasClient  *gas.Client
-	httpClient *http.Client
-	stats      stats.Expenses
+	bot           *tb.Bot
+	aclUsers      map[int64]acl.Role
+	acl           *acl.ACL
+	gasUser       users.User // GAS web app of unregistered users
+	gasSocks      string
+	gasRetry      gas.RetryPolicy
+	gasBatch      int
+	httpClient    *http.Client
+	apiURL        string
+	dataDir       string
+	usersFile     string
+	users         *users.Registry
+	defaultTenant *tenant
+	tenants       map[int64]*tenant
+	tenantsMu     sync.Mutex
+	reports       string
+	rulesFile     string
+	categories    *categories.Rules
+	budgets       budget.Budgets
+	digests       []digest.Digest
+	webhook       *Webhook
+	duplicates    *Duplicates
+	ctx           context.Context // Cancelled on shutdown, stops background jobs
+	cancel        context.CancelFunc
+	uploads       *uploads.Pool
+	handlers      sync.WaitGroup // Handlers in progress
+	workers       int
+	queueSize     int
+	timeout       time.Duration
 }
 
+// Sources of /today, /week, /month and /year reports
+const (
+	REPORTS_GAS   = "gas"
+	REPORTS_LOCAL = "local"
+)
+
+const (
+	OUTBOX_INTERVAL  = 1 * time.Minute
+	SHUTDOWN_DEFAULT = 8 * time.Second
+	MAX_QUEUE_ITEMS  = 20
+	TOP_DEFAULT      = 10
+)
+
 type BotOption func(b *Bot)
 
 func WithSocks(socks string) BotOption {
@@ -34,161 +83,975 @@ func WithSocks(socks string) BotOption {
 	}
 }
 
-func WithAdmin(a string) BotOption {
+// WithAPIURL sets Telegram Bot API server, e.g. local one, the official server is used by default
+func WithAPIURL(url string) BotOption {
 	return func(b *Bot) {
-		b.admin = a
+		b.apiURL = url
+	}
+}
+
+// WithACL restricts access to the specified Telegram user IDs. They seed the ACL on the first start,
+// persisted ACL is used afterwards, so roles granted and revoked at runtime are kept.
+func WithACL(users map[int64]acl.Role) BotOption {
+	return func(b *Bot) {
+		b.aclUsers = users
 	}
 }
 
 func WithGAS(url string, socks string, id string, secret string) BotOption {
 	return func(b *Bot) {
-		b.gasClient = gas.NewClient(url, socks, id, secret)
+		b.gasUser = users.User{GASURL: url, GASClientID: id, GASClientSecret: secret}
+		b.gasSocks = socks
+	}
+}
+
+// WithGASRetry sets retry policy of uploads and reports for all GAS web apps
+func WithGASRetry(policy gas.RetryPolicy) BotOption {
+	return func(b *Bot) {
+		b.gasRetry = policy
+	}
+}
+
+// WithGASBatch sets the maximum number of queued purchases uploaded with a single request, batches are disabled by default
+func WithGASBatch(size int) BotOption {
+	return func(b *Bot) {
+		b.gasBatch = size
+	}
+}
+
+// WithDataDir enables persistence of bot state to the specified directory
+func WithDataDir(dir string) BotOption {
+	return func(b *Bot) {
+		b.dataDir = dir
+	}
+}
+
+// WithReports selects source of period reports: REPORTS_GAS or REPORTS_LOCAL
+func WithReports(source string) BotOption {
+	return func(b *Bot) {
+		b.reports = source
+	}
+}
+
+// WithCategories loads merchant categorisation rules from YAML or JSON file
+func WithCategories(file string) BotOption {
+	return func(b *Bot) {
+		b.rulesFile = file
+	}
+}
+
+// WithBudgets sets monthly limits, purchases are checked against them right after recording
+func WithBudgets(budgets budget.Budgets) BotOption {
+	return func(b *Bot) {
+		b.budgets = budgets
+	}
+}
+
+// WithDigests schedules summaries sent to admins
+func WithDigests(digests []digest.Digest) BotOption {
+	return func(b *Bot) {
+		b.digests = digests
+	}
+}
+
+// WithWebhook receives updates with webhook instead of long polling if public URL is specified
+func WithWebhook(listen string, publicURL string, secret string, certFile string, keyFile string) BotOption {
+	return func(b *Bot) {
+		if publicURL != "" {
+			b.webhook = NewWebhook(listen, publicURL, secret, certFile, keyFile)
+		}
+	}
+}
+
+// WithShutdownTimeout limits the time uploads in progress are waited for on shutdown
+func WithShutdownTimeout(timeout time.Duration) BotOption {
+	return func(b *Bot) {
+		b.timeout = timeout
+	}
+}
+
+// WithUploads sets the number of concurrent GAS uploads and the number of purchases waiting for upload.
+// Handlers wait when the queue is full.
+func WithUploads(workers int, queueSize int) BotOption {
+	return func(b *Bot) {
+		b.workers = workers
+		b.queueSize = queueSize
+	}
+}
+
+// WithUsersFile registers users from YAML or JSON file at startup
+func WithUsersFile(path string) BotOption {
+	return func(b *Bot) {
+		b.usersFile = path
 	}
 }
 
 func NewBot(telegramToken string, opts ...BotOption) (*Bot, error) {
 	b := &Bot{
-		stats: stats.NewExpenses(),
+		tenants:    make(map[int64]*tenant),
+		reports:    REPORTS_GAS,
+		timeout:    SHUTDOWN_DEFAULT,
+		workers:    uploads.WORKERS,
+		queueSize:  uploads.QUEUE_SIZE,
+		gasRetry:   gas.DefaultRetryPolicy(),
+		gasBatch:   gas.BATCH_SIZE,
+		duplicates: NewDuplicates(MAX_DUPLICATES),
 	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
 
 	for _, opt := range opts {
 		opt(b)
 	}
 
+	if b.reports != REPORTS_GAS && b.reports != REPORTS_LOCAL {
+		return nil, fmt.Errorf("unknown reports source %q", b.reports)
+	}
+	if b.workers < 1 || b.queueSize < 0 {
+		return nil, fmt.Errorf("invalid upload pool size %d, queue size %d", b.workers, b.queueSize)
+	}
+	if b.webhook != nil && b.webhook.secret == "" {
+		return nil, fmt.Errorf("webhook secret is required, otherwise anyone who knows webhook URL may forge updates")
+	}
+	if b.gasBatch < 1 || b.gasBatch > gas.MAX_BATCH_SIZE {
+		return nil, fmt.Errorf("invalid GAS batch size %d, it should be from 1 to %d", b.gasBatch, gas.MAX_BATCH_SIZE)
+	}
+	b.uploads = uploads.New(b.workers, b.queueSize)
+
+	gasClient, err := b.newGASClient(&b.gasUser)
+	if err != nil {
+		return nil, err
+	}
+	b.defaultTenant, err = newTenant(b.dataDir, gasClient)
+	if err != nil {
+		return nil, err
+	}
+
+	b.acl, err = acl.New(dataPath(b.dataDir, "acl.json"), b.aclUsers)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load ACL: %w", err)
+	}
+	if b.acl.IsEmpty() {
+		log.Warnf("ACL is empty, bot is accessible to nobody")
+	}
+	current := b.acl.List()
+	for id, role := range b.aclUsers {
+		if current[id] != role {
+			log.Warnf("ACL is loaded from acl.json, Telegram users are applied on the first start only, role of user %d is %s", id, current[id])
+		}
+	}
+
+	b.categories, err = categories.New(b.rulesFile, dataPath(b.dataDir, "categories.json"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load categories: %w", err)
+	}
+
+	b.users, err = users.New(dataPath(b.dataDir, "users.json"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load users: %w", err)
+	}
+	if b.usersFile != "" {
+		if err := b.users.LoadFile(b.usersFile); err != nil {
+			return nil, fmt.Errorf("unable to load users: %w", err)
+		}
+	}
+	// Broken settings of a single user don't prevent the bot from starting, so admin is able to fix them
+	for _, u := range b.users.List() {
+		if _, err := b.userTenant(&u); err != nil {
+			log.Errorf("User %d is unavailable, register it again to fix: %v", u.ID, err)
+		}
+	}
+	log.Infof("Loaded %d users", len(b.users.List()))
+	for _, d := range b.digests {
+		log.Infof("Digest %s, next one at %s", d, d.Next(time.Now()).Format(time.DateTime))
+	}
+
+	var poller tb.Poller = &tb.LongPoller{Timeout: 10 * time.Second}
+	if b.webhook != nil {
+		poller = b.webhook
+	}
 	bot, err := tb.NewBot(tb.Settings{
-		Token:  telegramToken,
-		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
-		Client: b.httpClient,
+		Token:       telegramToken,
+		URL:         b.apiURL,
+		Poller:      poller,
+		Client:      b.httpClient,
+		Synchronous: true, // Handlers are run with goroutines by handle, so shutdown is able to wait for them
 	})
 	if err != nil {
 		return nil, err
 	}
 	log.Infof("Authorized on account %s\n", bot.Me.Username)
 
+	if b.webhook != nil {
+		if err := b.webhook.register(bot); err != nil {
+			return nil, fmt.Errorf("unable to set webhook: %w", err)
+		}
+		log.Infof("Webhook is set to %s", b.webhook.publicURL)
+	} else if err := bot.RemoveWebhook(); err != nil {
+		// Long polling doesn't work while webhook is set, it may be left after running in webhook mode
+		log.Warnf("Unable to remove webhook: %v", err)
+	}
+
 	b.bot = bot
 	return b, nil
 }
 
-func (b *Bot) Start() {
-	check := func(ctx context.Context, cmd string, m *tb.Message) bool {
-		logger.Log(ctx, nil).WithField("sender", m.Sender.Username).WithField("command", cmd).Infof("command")
-		if b.admin != "" && b.admin != m.Sender.Username {
+// Start handles updates until context is cancelled, then shuts down gracefully: background jobs are stopped
+// and uploads in progress are waited for. Uploads which are not finished in time are cancelled and queued to outbox.
+func (b *Bot) Start(ctx context.Context) {
+	check := func(ctx context.Context, cmd string, m *tb.Message, role acl.Role) bool {
+		logger.Log(ctx, nil).WithField("sender", m.Sender.Username).WithField("sender_id", m.Sender.ID).WithField("command", cmd).Infof("command")
+		if !b.acl.Allowed(m.Sender.ID, role) {
+			logger.Log(ctx, nil).WithField("sender_id", m.Sender.ID).WithField("required", role).Warnf("access restricted")
 			b.bot.Send(m.Sender, "ERROR: Access restricted")
 			return false
 		}
 		return true
 	}
 
-	add := func(ctx context.Context, p *purchases.Purchase) {
-		b.stats.Add(p)
-		resp, err := b.gasClient.Add(ctx, p)
+	getTenant := func(ctx context.Context, m *tb.Message) *tenant {
+		t, err := b.tenant(m.Sender)
+		if err != nil {
+			logger.Log(ctx, err).Errorf("error")
+			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
+			return nil
+		}
+		return t
+	}
+
+	// add records purchase and hands it to upload pool, reply is edited with the upload status.
+	// Purchase is queued to outbox when upload fails or the pool is closed already.
+	add := func(ctx context.Context, t *tenant, p *purchases.Purchase, reply *tb.Message) {
+		t.stats.Add(p)
+		if err := t.statsStore.Save(t.stats); err != nil {
+			logger.Log(ctx, err).Errorf("unable to save stats")
+		}
+		// status edits the reply with upload result, intermediate states are not shown
+		// to keep within Telegram limits of edits per chat
+		status := func(s string) {
+			if reply == nil {
+				return
+			}
+			if _, err := b.bot.Edit(reply, formatPurchase(p)+"\n"+s); err != nil {
+				logger.Log(ctx, err).Errorf("unable to edit reply")
+			}
+		}
+		queue := func(err error) {
+			logger.Log(ctx, err).Errorf("error")
+			var r *outbox.Reply
+			if reply != nil {
+				r = &outbox.Reply{ChatID: reply.Chat.ID, MessageID: reply.ID}
+			}
+			item, err1 := t.outbox.Push(p, err, r)
+			if err1 != nil {
+				logger.Log(ctx, err1).Errorf("unable to save outbox")
+			}
+			logger.Log(ctx, nil).WithField("outbox_id", item.ID).Infof("purchase is queued")
+			status(fmt.Sprintf("Upload failed: %v\nQueued for retry as #%d", err, item.ID))
+		}
+		u := &upload{purchase: p, status: status, queue: queue}
+		t.push(u)
+		// Every purchase has its own job, but the job uploads all purchases of the tenant waiting by then,
+		// so jobs of purchases taken by earlier batches have nothing to do
+		err := b.uploads.Submit(ctx, func(ctx context.Context) (int, int) {
+			batch := t.take(b.gasBatch)
+			if len(batch) == 0 {
+				return 0, 0
+			}
+			pp := make([]*purchases.Purchase, 0, len(batch))
+			for _, u := range batch {
+				pp = append(pp, u.purchase)
+			}
+			failed := 0
+			for i, r := range t.upload(ctx, pp) {
+				if r.Err != nil {
+					batch[i].queue(r.Err)
+					failed++
+					continue
+				}
+				batch[i].status(fmt.Sprintf("Uploaded: %s", r.Message))
+			}
+			return len(batch) - failed, failed
+		})
+		if err != nil && t.cancel(u) {
+			queue(err)
+		}
+	}
+
+	// ingest parses the message, replies with the parsed purchase and hands it to upload.
+	// Purchase which was recorded already is skipped unless force is set.
+	ingest := func(ctx context.Context, sender *tb.User, m *tb.Message, text string, force bool) {
+		t, err := b.tenant(sender)
 		if err != nil {
 			logger.Log(ctx, err).Errorf("error")
+			b.bot.Reply(m, fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+		p, err := purchases.New(getTime(m), text)
+		if err != nil {
+			logger.Log(ctx, err).Errorf("error")
+			b.bot.Reply(m, fmt.Sprintf("Not recognised: %v", err))
+			return
+		}
+		p.Category = b.categories.Categorize(p.Merchant)
+		added, err := t.history.Add(p, force)
+		if err != nil {
+			logger.Log(ctx, err).Errorf("unable to save history")
+		}
+		if !added {
+			logger.Log(ctx, nil).WithField("id", p.ID()).Infof("duplicate purchase")
+			reply, err := b.bot.Reply(m, formatPurchase(p)+"\nAlready recorded, reply /force to this message to add it anyway")
+			if err != nil {
+				logger.Log(ctx, err).Errorf("unable to reply")
+				return
+			}
+			b.duplicates.Add(reply, m)
+			return
+		}
+		if p.CancelOf != "" {
+			logger.Log(ctx, nil).WithField("id", p.ID()).WithField("original_id", p.CancelOf).Infof("cancel is linked")
+		}
+		reply, err := b.bot.Reply(m, formatPurchase(p)+fmt.Sprintf("\nQueued for upload, position %d", b.uploads.Len()+1))
+		if err != nil {
+			logger.Log(ctx, err).Errorf("unable to reply")
+		}
+		add(ctx, t, p, reply)
+		for _, alert := range b.budgets.Alerts(t.history.List(), p) {
+			logger.Log(ctx, nil).WithField("alert", alert).Infof("budget")
+			b.bot.Send(sender, alert)
+		}
+	}
+
+	// period sends report for the period requested by the command
+	period := func(ctx context.Context, m *tb.Message, command string) {
+		t := getTenant(ctx, m)
+		if t == nil {
+			return
+		}
+		p, err := stats.ParsePeriod(command, m.Payload, time.Now())
+		if err != nil {
+			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
 			return
 		}
-		logger.Log(ctx, nil).WithField("purchase", resp).Infof("purchase")
+		b.bot.Send(m.Sender, b.report(ctx, t, command, p, strings.TrimSpace(m.Payload) != ""))
 	}
 
-	b.bot.Handle("/status", func(m *tb.Message) {
+	b.defaultTenant.run(b.ctx, b.gasBatch, b.notifyOutbox)
+	digest.Run(b.ctx, b.digests, b.sendDigest)
+
+	b.handle("/status", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/status", m, acl.READER) {
+			return
+		}
+		b.bot.Send(m.Sender, "I'm fine\n"+b.uploads.Stats().String())
+	})
+
+	b.handle("/today", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/today", m, acl.READER) {
+			return
+		}
+		period(ctx, m, "today")
+	})
+
+	b.handle("/week", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/week", m, acl.READER) {
+			return
+		}
+		period(ctx, m, "week")
+	})
+
+	b.handle("/month", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/month", m, acl.READER) {
+			return
+		}
+		period(ctx, m, "month")
+	})
+
+	b.handle("/year", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/year", m, acl.READER) {
+			return
+		}
+		period(ctx, m, "year")
+	})
+
+	b.handle("/range", func(m *tb.Message) {
 		ctx := logger.WithMessageID(m.ID)
-		if !check(ctx, "/status", m) {
+		if !check(ctx, "/range", m, acl.READER) {
 			return
 		}
-		b.bot.Send(m.Sender, "I'm fine")
+		period(ctx, m, "range")
 	})
 
-	b.bot.Handle("/today", func(m *tb.Message) {
+	b.handle("/top", func(m *tb.Message) {
 		ctx := logger.WithMessageID(m.ID)
-		if !check(ctx, "/today", m) {
+		if !check(ctx, "/top", m, acl.READER) {
+			return
+		}
+		t := getTenant(ctx, m)
+		if t == nil {
 			return
 		}
-		resp, err := b.gasClient.Get(ctx, "today")
+		args := strings.Fields(m.Payload)
+		n := TOP_DEFAULT
+		if len(args) > 0 {
+			if n1, err := strconv.Atoi(args[0]); err == nil && n1 > 0 {
+				n, args = n1, args[1:]
+			}
+		}
+		p, err := parsePeriodArgs(args, "month")
+		if err != nil {
+			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v\nUsage: /top [N] [today|week|month|year|range] [argument]", err))
+			return
+		}
+		b.bot.Send(m.Sender, stats.Top(t.history.List(), p, n))
+	})
+
+	b.handle("/merchant", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/merchant", m, acl.READER) {
+			return
+		}
+		t := getTenant(ctx, m)
+		if t == nil {
+			return
+		}
+		args := strings.Fields(m.Payload)
+		i := slices.IndexFunc(args, stats.IsPeriodName)
+		if i < 0 {
+			i = len(args)
+		}
+		merchant := strings.Join(args[:i], " ")
+		p, err := parsePeriodArgs(args[i:], "year")
+		if err == nil && merchant == "" {
+			err = fmt.Errorf("merchant is not specified")
+		}
+		if err != nil {
+			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v\nUsage: /merchant <merchant> [today|week|month|year|range] [argument]", err))
+			return
+		}
+		b.bot.Send(m.Sender, stats.Merchant(t.history.List(), p, merchant))
+	})
+
+	b.handle("/budget", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/budget", m, acl.READER) {
+			return
+		}
+		t := getTenant(ctx, m)
+		if t == nil {
+			return
+		}
+		if len(b.budgets) == 0 {
+			b.bot.Send(m.Sender, "No budgets are configured")
+			return
+		}
+		month, err := stats.NewPeriod("month", time.Now())
 		if err != nil {
 			logger.Log(ctx, err).Errorf("error")
 			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
 			return
 		}
-		b.bot.Send(m.Sender, resp)
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "Budgets for %s:", month.From.Format("01.2006"))
+		for _, s := range b.budgets.Status(t.history.List(), month) {
+			fmt.Fprintf(&sb, "\n%s", s)
+		}
+		b.bot.Send(m.Sender, sb.String())
 	})
 
-	b.bot.Handle("/week", func(m *tb.Message) {
+	b.handle("/stats", func(m *tb.Message) {
 		ctx := logger.WithMessageID(m.ID)
-		if !check(ctx, "/week", m) {
+		if !check(ctx, "/stats", m, acl.READER) {
 			return
 		}
-		resp, err := b.gasClient.Get(ctx, "week")
-		if err != nil {
+		t := getTenant(ctx, m)
+		if t == nil {
+			return
+		}
+		args := strings.Fields(m.Payload)
+		asJSON := len(args) > 0 && args[0] == "json"
+		if asJSON {
+			args = args[1:]
+		}
+		e := t.stats
+		header := ""
+		if len(args) > 0 {
+			p, err := parsePeriodArgs(args, "")
+			if err != nil {
+				b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
+				return
+			}
+			e = e.Filter(p)
+			header = p.String() + "\n"
+		}
+		if asJSON {
+			jsonStats, err := e.Stats()
+			if err != nil {
+				logger.Log(ctx, err).Errorf("error")
+				jsonStats = err.Error()
+			}
+			b.bot.Send(m.Sender, jsonStats)
+			return
+		}
+		b.bot.Send(m.Sender, header+e.Format(), tb.ModeHTML)
+	})
+
+	b.handle("/queue", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/queue", m, acl.READER) {
+			return
+		}
+		t := getTenant(ctx, m)
+		if t == nil {
+			return
+		}
+		if m.Payload == "retry" {
+			if !check(ctx, "/queue retry", m, acl.WRITER) {
+				return
+			}
+			n, err := t.outbox.Retry()
+			if err != nil {
+				logger.Log(ctx, err).Errorf("error")
+				b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
+				return
+			}
+			b.bot.Send(m.Sender, fmt.Sprintf("%d failed purchases will be retried", n))
+			return
+		}
+		b.bot.Send(m.Sender, formatQueue(t.outbox.List()))
+	})
+
+	b.handle("/force", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/force", m, acl.WRITER) {
+			return
+		}
+		if m.ReplyTo != nil {
+			original := m.ReplyTo
+			if o := b.duplicates.Original(m.ReplyTo); o != nil {
+				original = o
+			} else if m.ReplyTo.Sender != nil && m.ReplyTo.Sender.ID == b.bot.Me.ID {
+				b.bot.Send(m.Sender, "Original message is unknown, reply /force to the forwarded message instead")
+				return
+			}
+			text := original.Text
+			if text == "" {
+				text = original.Caption
+			}
+			ingest(ctx, m.Sender, original, text, true)
+			return
+		}
+		if m.Payload == "" {
+			b.bot.Send(m.Sender, "Reply /force to the message or specify it as /force <text>")
+			return
+		}
+		ingest(ctx, m.Sender, m, m.Payload, true)
+	})
+
+	b.handle("/category", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/category", m, acl.READER) {
+			return
+		}
+		merchant, category := parseCategory(m.Payload)
+		if merchant == "" {
+			b.bot.Send(m.Sender, formatRules(b.categories.List()))
+			return
+		}
+		if category == "" {
+			b.bot.Send(m.Sender, fmt.Sprintf("%s: %s", merchant, b.categories.Categorize(merchant)))
+			return
+		}
+		if !check(ctx, "/category", m, acl.WRITER) {
+			return
+		}
+		if err := b.categories.Set(merchant, category); err != nil {
 			logger.Log(ctx, err).Errorf("error")
 			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
 			return
 		}
-		b.bot.Send(m.Sender, resp)
+		logger.Log(ctx, nil).WithField("merchant", merchant).WithField("category", category).Infof("category is set")
+		b.bot.Send(m.Sender, fmt.Sprintf("%s: %s", merchant, category))
 	})
 
-	b.bot.Handle("/month", func(m *tb.Message) {
+	b.handle("/register", func(m *tb.Message) {
 		ctx := logger.WithMessageID(m.ID)
-		if !check(ctx, "/month", m) {
+		if !check(ctx, "/register", m, acl.ADMIN) {
 			return
 		}
-		resp, err := b.gasClient.Get(ctx, "month")
+		u, err := parseUser(m.Payload)
 		if err != nil {
+			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v\nUsage: /register <user id> <GAS url> [<client id> <client secret>]", err))
+			return
+		}
+		if err := b.register(u); err != nil {
 			logger.Log(ctx, err).Errorf("error")
 			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
 			return
 		}
-		b.bot.Send(m.Sender, resp)
+		logger.Log(ctx, nil).WithField("user_id", u.ID).Infof("user is registered")
+		b.bot.Send(m.Sender, fmt.Sprintf("User %d is registered", u.ID))
 	})
 
-	b.bot.Handle("/year", func(m *tb.Message) {
+	b.handle("/unregister", func(m *tb.Message) {
 		ctx := logger.WithMessageID(m.ID)
-		if !check(ctx, "/year", m) {
+		if !check(ctx, "/unregister", m, acl.ADMIN) {
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(m.Payload), 10, 64)
+		if err != nil {
+			b.bot.Send(m.Sender, "Usage: /unregister <user id>")
 			return
 		}
-		resp, err := b.gasClient.Get(ctx, "year")
+		ok, err := b.unregister(id)
 		if err != nil {
 			logger.Log(ctx, err).Errorf("error")
 			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
 			return
 		}
-		b.bot.Send(m.Sender, resp)
+		if !ok {
+			b.bot.Send(m.Sender, fmt.Sprintf("User %d is not registered", id))
+			return
+		}
+		logger.Log(ctx, nil).WithField("user_id", id).Infof("user is unregistered")
+		b.bot.Send(m.Sender, fmt.Sprintf("User %d is unregistered", id))
+	})
+
+	b.handle("/users", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/users", m, acl.ADMIN) {
+			return
+		}
+		b.bot.Send(m.Sender, formatUsers(b.users.List()))
 	})
 
-	b.bot.Handle("/stats", func(m *tb.Message) {
+	b.handle("/grant", func(m *tb.Message) {
 		ctx := logger.WithMessageID(m.ID)
-		if !check(ctx, "/stats", m) {
+		if !check(ctx, "/grant", m, acl.ADMIN) {
 			return
 		}
-		jsonStats, err := b.stats.Stats()
+		users, err := acl.ParseUsers(strings.Join(strings.Fields(m.Payload), ":"))
+		if err == nil && len(users) != 1 {
+			err = fmt.Errorf("wrong number of arguments")
+		}
 		if err != nil {
-			logger.Log(ctx, err).Errorf("error")
-			jsonStats = err.Error()
+			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v\nUsage: /grant <user id> <reader|writer|admin>", err))
+			return
+		}
+		for id, role := range users {
+			if err := b.acl.Grant(id, role); err != nil {
+				logger.Log(ctx, err).Errorf("error")
+				b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
+				return
+			}
+			logger.Log(ctx, nil).WithField("user_id", id).WithField("role", role).Infof("access granted")
+			b.bot.Send(m.Sender, fmt.Sprintf("User %d is %s now", id, role))
 		}
-		b.bot.Send(m.Sender, jsonStats)
 	})
 
-	b.bot.Handle(tb.OnText, func(m *tb.Message) {
+	b.handle("/revoke", func(m *tb.Message) {
 		ctx := logger.WithMessageID(m.ID)
-		logger.Log(ctx, nil).WithField("text", m.Text).WithField("forwarded", m.IsForwarded()).Infof("text")
-		p, err := purchases.New(getTime(m), m.Text)
+		if !check(ctx, "/revoke", m, acl.ADMIN) {
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(m.Payload), 10, 64)
+		if err != nil {
+			b.bot.Send(m.Sender, "Usage: /revoke <user id>")
+			return
+		}
+		if id == m.Sender.ID {
+			b.bot.Send(m.Sender, "ERROR: You can't revoke your own access")
+			return
+		}
+		ok, err := b.acl.Revoke(id)
 		if err != nil {
 			logger.Log(ctx, err).Errorf("error")
+			b.bot.Send(m.Sender, fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+		if !ok {
+			b.bot.Send(m.Sender, fmt.Sprintf("User %d has no access", id))
+			return
+		}
+		logger.Log(ctx, nil).WithField("user_id", id).Infof("access revoked")
+		b.bot.Send(m.Sender, fmt.Sprintf("Access of user %d is revoked", id))
+	})
+
+	b.handle("/acl", func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		if !check(ctx, "/acl", m, acl.ADMIN) {
+			return
+		}
+		b.bot.Send(m.Sender, formatACL(b.acl.List()))
+	})
+
+	b.handle(tb.OnText, func(m *tb.Message) {
+		ctx := logger.WithMessageID(m.ID)
+		logger.Log(ctx, nil).WithField("text", m.Text).WithField("forwarded", m.IsForwarded()).Infof("text")
+		if !check(ctx, "text", m, acl.WRITER) {
 			return
 		}
-		add(ctx, p)
+		ingest(ctx, m.Sender, m, m.Text, false)
 	})
 
-	b.bot.Handle(tb.OnPhoto, func(m *tb.Message) {
+	b.handle(tb.OnPhoto, func(m *tb.Message) {
 		ctx := logger.WithMessageID(m.ID)
 		logger.Log(ctx, nil).WithField("caption", m.Caption).WithField("forwarded", m.IsForwarded()).Infof("photo with caption")
-		p, err := purchases.New(getTime(m), m.Caption)
-		if err != nil {
-			logger.Log(ctx, err).Errorf("error")
+		if !check(ctx, "photo", m, acl.WRITER) {
 			return
 		}
-		add(ctx, p)
+		ingest(ctx, m.Sender, m, m.Caption, false)
 	})
 
+	go func() {
+		<-ctx.Done()
+		log.Infof("Stopping bot")
+		b.bot.Stop()
+	}()
 	b.bot.Start()
+	b.shutdown()
+}
+
+// handle registers handler which runs in its own goroutine. Goroutine is counted before bot.Start returns,
+// so shutdown waits for updates received already, e.g. purchases being recorded.
+func (b *Bot) handle(endpoint interface{}, h func(m *tb.Message)) {
+	b.bot.Handle(endpoint, func(m *tb.Message) {
+		b.handlers.Add(1)
+		go func() {
+			defer b.handlers.Done()
+			h(m)
+		}()
+	})
+}
+
+// shutdown waits for handlers in progress, stops background jobs, waits for queued uploads and saves tenants state.
+// Handlers and uploads share the shutdown timeout.
+func (b *Bot) shutdown() {
+	deadline := time.Now().Add(b.timeout)
+	handled := make(chan struct{})
+	go func() {
+		b.handlers.Wait()
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(b.timeout):
+		log.Warnf("Handlers were not finished in %v", b.timeout)
+	}
+	b.cancel()
+	if !b.uploads.Close(max(time.Until(deadline), 0)) {
+		log.Warnf("Uploads were not finished in %v, they are queued for retry", b.timeout)
+	}
+	b.tenantsMu.Lock()
+	defer b.tenantsMu.Unlock()
+	b.defaultTenant.close()
+	for _, t := range b.tenants {
+		t.close()
+	}
+	log.Infof("Bot is stopped")
+}
+
+// report returns report for the period from GAS or computed from local history.
+// Local report is returned when GAS is unavailable as well. Period bounds are passed to GAS if bounded is set.
+func (b *Bot) report(ctx context.Context, t *tenant, command string, p stats.Period, bounded bool) string {
+	var gasErr error
+	if b.reports == REPORTS_GAS {
+		var params url.Values
+		if bounded {
+			params = url.Values{}
+			params.Add("from", p.From.Format(purchases.DateLayout))
+			params.Add("to", p.Last().Format(purchases.DateLayout))
+		}
+		resp, err := t.gas().Get(ctx, command, params)
+		if err == nil {
+			return resp
+		}
+		logger.Log(ctx, err).Errorf("error")
+		gasErr = err
+	}
+	report := stats.NewReport(t.history.List(), p).String()
+	if gasErr != nil {
+		report = fmt.Sprintf("ERROR: %v\nLocal report:\n%s", gasErr, report)
+	}
+	return report
+}
+
+// sendDigest sends digest of the period to every admin, each admin gets report of own tenant
+func (b *Bot) sendDigest(ctx context.Context, d digest.Digest, p stats.Period) {
+	admins := b.acl.Admins()
+	if len(admins) == 0 {
+		logger.Log(ctx, nil).WithField("digest", d.Kind).Warnf("there are no admins to send digest to")
+		return
+	}
+	for _, id := range admins {
+		admin := &tb.User{ID: id}
+		t, err := b.tenant(admin)
+		if err != nil {
+			logger.Log(ctx, err).WithField("user_id", id).Errorf("error")
+			continue
+		}
+		// GAS web app has to take the period from bounds, command name doesn't match it
+		report := b.report(ctx, t, "range", p, true)
+		title := strings.ToUpper(d.Kind[:1]) + d.Kind[1:]
+		if _, err := b.bot.Send(admin, fmt.Sprintf("%s digest\n%s", title, report)); err != nil {
+			logger.Log(ctx, err).WithField("user_id", id).Errorf("unable to send digest")
+			continue
+		}
+		logger.Log(ctx, nil).WithField("user_id", id).WithField("digest", d.Kind).Infof("digest is sent")
+	}
+}
+
+func formatPurchase(p *purchases.Purchase) string {
+	var sb strings.Builder
+	if p.Operation != purchases.Buy {
+		fmt.Fprintf(&sb, "Operation: %s\n", p.Operation)
+	}
+	if p.Merchant != "" {
+		fmt.Fprintf(&sb, "%s\n", p.Merchant)
+	}
+	fmt.Fprintf(&sb, "Amount: %.2f %s", p.Price, p.Currency)
+	if p.PriceRUB != p.Price {
+		fmt.Fprintf(&sb, " (%.2f ₽)", p.PriceRUB)
+	}
+	if p.Card != "" {
+		fmt.Fprintf(&sb, "\nCard: %s", p.Card)
+	}
+	if p.Category != "" {
+		fmt.Fprintf(&sb, "\nCategory: %s", p.Category)
+	}
+	fmt.Fprintf(&sb, "\nTime: %s", p.Time.Format("02.01.2006 15:04"))
+	if p.CancelOf != "" {
+		fmt.Fprintf(&sb, "\nReverses purchase %s", p.CancelOf)
+	}
+	return sb.String()
+}
+
+// notifyOutbox edits the reply of outbox item when it's finally delivered or failed
+func (b *Bot) notifyOutbox(ctx context.Context, item outbox.Item, delivered bool) {
+	if item.Reply == nil {
+		return
+	}
+	s := fmt.Sprintf("Uploaded after %d attempts", item.Attempts+1)
+	if !delivered {
+		s = fmt.Sprintf("Upload failed after %d attempts: %s\nUse /queue retry to try again", item.Attempts, item.LastError)
+	}
+	reply := tb.StoredMessage{MessageID: strconv.Itoa(item.Reply.MessageID), ChatID: item.Reply.ChatID}
+	if _, err := b.bot.Edit(reply, formatPurchase(item.Purchase)+"\n"+s); err != nil {
+		logger.Log(ctx, err).Errorf("unable to edit reply")
+	}
+}
+
+func formatQueue(items []outbox.Item) string {
+	if len(items) == 0 {
+		return "Queue is empty"
+	}
+	var pending, failed int
+	var sb strings.Builder
+	for i, item := range items {
+		if item.Status == outbox.FAILED {
+			failed++
+		} else {
+			pending++
+		}
+		if i == MAX_QUEUE_ITEMS {
+			fmt.Fprintf(&sb, "\n...and %d more", len(items)-MAX_QUEUE_ITEMS)
+		}
+		if i >= MAX_QUEUE_ITEMS {
+			continue
+		}
+		p := item.Purchase
+		fmt.Fprintf(&sb, "\n#%d %s, attempts %d: %s %s %.2f %s", item.ID, item.Status, item.Attempts,
+			p.Time.Format("02.01.2006 15:04"), p.Merchant, p.Price, p.Currency)
+		if item.Status == outbox.PENDING {
+			fmt.Fprintf(&sb, ", next try at %s", item.NextTry.Format(time.TimeOnly))
+		}
+		fmt.Fprintf(&sb, "\nLast error: %s", item.LastError)
+	}
+	return fmt.Sprintf("Pending: %d, failed: %d%s", pending, failed, sb.String())
+}
+
+func formatACL(users map[int64]acl.Role) string {
+	if len(users) == 0 {
+		return "ACL is empty, bot is accessible to everyone"
+	}
+	ids := make([]int64, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	var sb strings.Builder
+	for _, id := range ids {
+		fmt.Fprintf(&sb, "%d %s\n", id, users[id])
+	}
+	return sb.String()
+}
+
+// parsePeriodArgs parses [<period name> [<argument>]] or range dates, period name defaults to def
+func parsePeriodArgs(args []string, def string) (stats.Period, error) {
+	name := def
+	if len(args) > 0 {
+		name = "range"
+		if stats.IsPeriodName(args[0]) {
+			name, args = args[0], args[1:]
+		}
+	}
+	return stats.ParsePeriod(name, strings.Join(args, " "), time.Now())
+}
+
+func formatRules(rules []categories.Rule) string {
+	if len(rules) == 0 {
+		return "No categories are set, use /category <merchant> = <category>"
+	}
+	var sb strings.Builder
+	for _, r := range rules {
+		fmt.Fprintf(&sb, "%s: %s\n", r.Pattern, r.Category)
+	}
+	return sb.String()
+}
+
+// parseCategory parses /category arguments: <merchant> = <category> sets the rule, <merchant> without "="
+// looks it up, so multi-word merchants are never mistaken for rules
+func parseCategory(s string) (string, string) {
+	if merchant, category, found := strings.Cut(s, "="); found {
+		return strings.TrimSpace(merchant), strings.TrimSpace(category)
+	}
+	return strings.Join(strings.Fields(s), " "), ""
+}
+
+func formatUsers(uu []users.User) string {
+	if len(uu) == 0 {
+		return "No registered users"
+	}
+	var sb strings.Builder
+	for _, u := range uu {
+		fmt.Fprintf(&sb, "%d %s %s\n", u.ID, u.Username, u.GASURL)
+	}
+	return sb.String()
+}
+
+// parseUser parses /register arguments: <user id> <GAS url> [<client id> <client secret>]
+func parseUser(s string) (*users.User, error) {
+	args := strings.Fields(s)
+	if len(args) != 2 && len(args) != 4 {
+		return nil, fmt.Errorf("wrong number of arguments")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user id %q", args[0])
+	}
+	if err := users.ValidateGASURL(args[1]); err != nil {
+		return nil, err
+	}
+	u := &users.User{ID: id, GASURL: args[1]}
+	if len(args) == 4 {
+		u.GASClientID = args[2]
+		u.GASClientSecret = args[3]
+	}
+	return u, nil
 }
 
 func getTime(m *tb.Message) time.Time {
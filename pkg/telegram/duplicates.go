@@ -0,0 +1,59 @@
+package telegram
+
+import (
+	"sync"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// MAX_DUPLICATES limits the number of remembered replies about duplicate purchases
+const MAX_DUPLICATES = 1000
+
+type messageKey struct {
+	chatID int64
+	id     int
+}
+
+// Duplicates maps bot replies about duplicate purchases to the original messages, so /force may be replied
+// to the bot's reply. Telegram doesn't pass the message which the replied one is a reply to itself.
+// Only the latest replies are kept in memory.
+type Duplicates struct {
+	mu       sync.Mutex
+	size     int
+	keys     []messageKey
+	messages map[messageKey]*tb.Message
+}
+
+func NewDuplicates(size int) *Duplicates {
+	return &Duplicates{size: size, messages: make(map[messageKey]*tb.Message)}
+}
+
+// Add remembers original message of the reply, the oldest reply is forgotten when size is exceeded
+func (d *Duplicates) Add(reply *tb.Message, original *tb.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	k := key(reply)
+	if _, ok := d.messages[k]; !ok {
+		d.keys = append(d.keys, k)
+	}
+	d.messages[k] = original
+	if len(d.keys) > d.size {
+		delete(d.messages, d.keys[0])
+		d.keys = d.keys[1:]
+	}
+}
+
+// Original returns original message of the reply or nil if it's unknown
+func (d *Duplicates) Original(reply *tb.Message) *tb.Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.messages[key(reply)]
+}
+
+func key(m *tb.Message) messageKey {
+	k := messageKey{id: m.ID}
+	if m.Chat != nil {
+		k.chatID = m.Chat.ID
+	}
+	return k
+}
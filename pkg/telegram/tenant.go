@@ -0,0 +1,237 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dddpaul/alfafin-bot/pkg/gas"
+	"github.com/dddpaul/alfafin-bot/pkg/history"
+	"github.com/dddpaul/alfafin-bot/pkg/logger"
+	"github.com/dddpaul/alfafin-bot/pkg/outbox"
+	"github.com/dddpaul/alfafin-bot/pkg/purchases"
+	"github.com/dddpaul/alfafin-bot/pkg/stats"
+	"github.com/dddpaul/alfafin-bot/pkg/users"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// tenant holds resources of a single bot user: GAS web app, expenses, history and outbox.
+// Unregistered senders share the default tenant configured with command line flags.
+type tenant struct {
+	gasClient  atomic.Pointer[gas.Client]
+	stats      stats.Expenses
+	statsStore stats.Store
+	outbox     *outbox.Outbox
+	history    *history.History
+	stop       context.CancelFunc // Stops outbox drain
+
+	pendingMu sync.Mutex
+	pending   []*upload
+}
+
+// upload is a purchase waiting for the upload pool. Status reports the progress to the sender,
+// queue puts purchase to outbox when upload fails.
+type upload struct {
+	purchase *purchases.Purchase
+	status   func(s string)
+	queue    func(err error)
+}
+
+// newTenant loads tenant state from the directory or keeps it in memory if dir is empty
+func newTenant(dir string, gasClient *gas.Client) (*tenant, error) {
+	t := &tenant{}
+	t.gasClient.Store(gasClient)
+
+	t.statsStore = stats.NewStore(dataPath(dir, "stats.json"))
+	e, err := t.statsStore.Load()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load stats: %w", err)
+	}
+	t.stats = e
+	log.Infof("Loaded %d expenses from %s", e.Count(), dataPath(dir, "stats.json"))
+
+	t.outbox, err = outbox.New(dataPath(dir, "outbox.json"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load outbox: %w", err)
+	}
+
+	t.history, err = history.New(dataPath(dir, "history.json"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load history: %w", err)
+	}
+	return t, nil
+}
+
+func (t *tenant) gas() *gas.Client {
+	return t.gasClient.Load()
+}
+
+// run drains tenant outbox in background, up to batchSize purchases are sent with a single request.
+// Notify reports final status of outbox items.
+func (t *tenant) run(ctx context.Context, batchSize int, notify outbox.Notifier) {
+	ctx, t.stop = context.WithCancel(ctx)
+	go t.outbox.Run(ctx, OUTBOX_INTERVAL, batchSize, func(ctx context.Context, pp []*purchases.Purchase) []error {
+		errs := make([]error, len(pp))
+		for i, r := range t.upload(ctx, pp) {
+			errs[i] = r.Err
+		}
+		return errs
+	}, notify)
+}
+
+// upload sends purchases to GAS, several purchases are sent with a single batch request
+func (t *tenant) upload(ctx context.Context, pp []*purchases.Purchase) []gas.Result {
+	if len(pp) == 1 {
+		resp, err := t.gas().Add(ctx, pp[0])
+		if err == nil {
+			logger.Log(ctx, nil).WithField("purchase", resp).Infof("purchase")
+		}
+		return []gas.Result{{Message: resp, Err: err}}
+	}
+	results, err := t.gas().AddBatch(ctx, pp)
+	if err != nil {
+		return results
+	}
+	for i, r := range results {
+		if r.Err == nil {
+			logger.Log(ctx, nil).WithField("id", pp[i].ID()).WithField("purchase", r.Message).Infof("purchase")
+		}
+	}
+	return results
+}
+
+// push adds purchase to the uploads waiting for the pool
+func (t *tenant) push(u *upload) {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+	t.pending = append(t.pending, u)
+}
+
+// take removes up to n oldest uploads, so they are sent together
+func (t *tenant) take(n int) []*upload {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+	n = min(max(n, 1), len(t.pending))
+	batch := append([]*upload(nil), t.pending[:n]...)
+	t.pending = t.pending[n:]
+	return batch
+}
+
+// cancel removes upload which was not taken yet and reports whether it was found
+func (t *tenant) cancel(u *upload) bool {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+	for i, u1 := range t.pending {
+		if u1 == u {
+			t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// close stops background jobs and saves tenant state, everything but stats is saved on every change already
+func (t *tenant) close() {
+	if t.stop != nil {
+		t.stop()
+	}
+	if err := t.statsStore.Save(t.stats); err != nil {
+		log.Errorf("Unable to save stats: %v", err)
+	}
+	if gasClient := t.gas(); gasClient != nil {
+		gasClient.Close()
+	}
+}
+
+// tenant returns resources of the registered sender or default tenant
+func (b *Bot) tenant(sender *tb.User) (*tenant, error) {
+	u := b.users.Get(sender.ID)
+	if u == nil {
+		return b.defaultTenant, nil
+	}
+	return b.userTenant(u)
+}
+
+// userTenant returns tenant of the registered user creating it on the first call
+func (b *Bot) userTenant(u *users.User) (*tenant, error) {
+	b.tenantsMu.Lock()
+	defer b.tenantsMu.Unlock()
+	if t, ok := b.tenants[u.ID]; ok {
+		return t, nil
+	}
+	gasClient, err := b.newGASClient(u)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTenant(b.userDir(u.ID), gasClient)
+	if err != nil {
+		return nil, err
+	}
+	t.run(b.ctx, b.gasBatch, b.notifyOutbox)
+	b.tenants[u.ID] = t
+	return t, nil
+}
+
+// register adds user or updates settings of the registered one. Settings are checked before they are saved,
+// so the bot is able to start with them.
+func (b *Bot) register(u *users.User) error {
+	gasClient, err := b.newGASClient(u)
+	if err != nil {
+		return err
+	}
+	if err := b.users.Register(u); err != nil {
+		return err
+	}
+	t, err := b.userTenant(u)
+	if err != nil {
+		return err
+	}
+	if old := t.gasClient.Swap(gasClient); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// unregister removes user and stops its tenant, tenant state is kept in its directory
+func (b *Bot) unregister(id int64) (bool, error) {
+	ok, err := b.users.Unregister(id)
+	if err != nil || !ok {
+		return ok, err
+	}
+	b.tenantsMu.Lock()
+	t := b.tenants[id]
+	delete(b.tenants, id)
+	b.tenantsMu.Unlock()
+	if t != nil {
+		t.close()
+	}
+	return true, nil
+}
+
+func (b *Bot) newGASClient(u *users.User) (*gas.Client, error) {
+	socks := u.GASProxyURL
+	if socks == "" {
+		socks = b.gasSocks
+	}
+	return gas.NewClient(u.GASURL, socks, u.GASClientID, u.GASClientSecret, gas.WithRetryPolicy(b.gasRetry))
+}
+
+func (b *Bot) userDir(id int64) string {
+	if b.dataDir == "" {
+		return ""
+	}
+	return filepath.Join(b.dataDir, "users", strconv.FormatInt(id, 10))
+}
+
+// dataPath returns path of the file inside data directory or empty string if persistence is disabled
+func dataPath(dir string, name string) string {
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
@@ -0,0 +1,110 @@
+package telegram
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// SECRET_HEADER carries secret token set with setWebhook in every update request
+const SECRET_HEADER = "X-Telegram-Bot-Api-Secret-Token"
+
+// SHUTDOWN_TIMEOUT limits the time webhook server waits for requests in progress on stop
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+// Webhook is a poller receiving updates from Telegram with HTTP requests. Unlike tb.Webhook it checks secret token,
+// so updates can't be forged by anyone who knows the public URL. Webhook is registered by NewBot.
+type Webhook struct {
+	listen    string
+	publicURL string
+	secret    string
+	certFile  string
+	keyFile   string
+	updates   chan tb.Update
+}
+
+// NewWebhook returns poller listening on the address, TLS is enabled when certificate and key files are specified.
+// Public URL is where Telegram sends updates to, e.g. URL of the reverse proxy. If listen is empty,
+// webhook has to be served by the caller as http.Handler.
+func NewWebhook(listen string, publicURL string, secret string, certFile string, keyFile string) *Webhook {
+	return &Webhook{
+		listen:    listen,
+		publicURL: publicURL,
+		secret:    secret,
+		certFile:  certFile,
+		keyFile:   keyFile,
+		updates:   make(chan tb.Update),
+	}
+}
+
+// register sets webhook of the bot
+func (w *Webhook) register(b *tb.Bot) error {
+	params := map[string]string{"url": w.publicURL}
+	if w.secret != "" {
+		params["secret_token"] = w.secret
+	}
+	_, err := b.Raw("setWebhook", params)
+	return err
+}
+
+// Poll serves HTTP requests and passes updates to the bot until stop is closed
+func (w *Webhook) Poll(b *tb.Bot, dest chan tb.Update, stop chan struct{}) {
+	if w.listen != "" {
+		s := &http.Server{Addr: w.listen, Handler: w}
+		go func() {
+			var err error
+			if w.certFile != "" {
+				err = s.ListenAndServeTLS(w.certFile, w.keyFile)
+			} else {
+				err = s.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("Webhook server failed: %v", err)
+			}
+		}()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+			defer cancel()
+			s.Shutdown(ctx)
+		}()
+		log.Infof("Listening for webhook updates on %s", w.listen)
+	}
+
+	for {
+		select {
+		case upd := <-w.updates:
+			dest <- upd
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if w.secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(SECRET_HEADER)), []byte(w.secret)) != 1 {
+		log.WithField("remote_addr", r.RemoteAddr).Warnf("webhook request with invalid secret token")
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var upd tb.Update
+	if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+		log.WithField("remote_addr", r.RemoteAddr).Errorf("cannot decode webhook update: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	select {
+	case w.updates <- upd:
+	case <-r.Context().Done():
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,164 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults keep concurrent GAS executions well below the quota of 30 per user described on gas.NewClient,
+// each GAS client limits its own request rate still.
+const (
+	WORKERS    = 4
+	QUEUE_SIZE = 100
+)
+
+var ErrClosed = errors.New("upload queue is closed")
+
+// Job uploads items and reports the number of uploaded and failed ones. Job which had nothing to do (e.g. its item
+// was uploaded by another job's batch) reports zeros and isn't counted in Stats. Context is cancelled when the pool
+// is closed and its timeout is exceeded.
+type Job func(ctx context.Context) (done int, failed int)
+
+type item struct {
+	ctx context.Context
+	job Job
+}
+
+// Pool runs jobs with a fixed number of workers. Jobs wait in a bounded queue, Submit blocks when the queue is full.
+type Pool struct {
+	queue   chan item
+	closing chan struct{}
+	mu      sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+	ctx     context.Context // Cancelled when close timeout is exceeded
+	cancel  context.CancelFunc
+
+	inProgress atomic.Int64
+	done       atomic.Int64 // Uploaded items
+	failed     atomic.Int64 // Failed items
+	jobs       atomic.Int64 // Finished jobs which uploaded something
+	busy       atomic.Int64 // Total duration of these jobs in nanoseconds
+}
+
+// Stats are pool metrics
+type Stats struct {
+	Queued     int
+	InProgress int64
+	Done       int64
+	Failed     int64
+	Average    time.Duration // Average duration of finished job, a single job may upload several items
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("Uploads: queued %d, in progress %d, done %d, failed %d, average time %v",
+		s.Queued, s.InProgress, s.Done, s.Failed, s.Average.Round(time.Millisecond))
+}
+
+// New starts pool with the specified number of workers and queue size
+func New(workers int, size int) *Pool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		queue:   make(chan item, size),
+		closing: make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Submit puts job into the queue waiting for free space until context is done. ErrClosed is returned
+// if the pool is closed.
+func (p *Pool) Submit(ctx context.Context, job Job) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	select {
+	case p.queue <- item{ctx: ctx, job: job}:
+		return nil
+	case <-p.closing:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len returns the number of jobs waiting in the queue
+func (p *Pool) Len() int {
+	return len(p.queue)
+}
+
+func (p *Pool) Stats() Stats {
+	s := Stats{
+		Queued:     len(p.queue),
+		InProgress: p.inProgress.Load(),
+		Done:       p.done.Load(),
+		Failed:     p.failed.Load(),
+	}
+	if jobs := p.jobs.Load(); jobs > 0 {
+		s.Average = time.Duration(p.busy.Load() / jobs)
+	}
+	return s
+}
+
+// Close rejects new jobs and waits for the queued ones. When timeout is exceeded, contexts of the remaining jobs
+// are cancelled, so they finish quickly, and false is returned.
+func (p *Pool) Close(timeout time.Duration) bool {
+	close(p.closing)
+	p.mu.Lock()
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		p.cancel()
+		<-done
+		return false
+	}
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for it := range p.queue {
+		p.run(it)
+	}
+}
+
+func (p *Pool) run(it item) {
+	ctx, cancel := context.WithCancel(it.ctx)
+	defer cancel()
+	stop := context.AfterFunc(p.ctx, cancel)
+	defer stop()
+
+	p.inProgress.Add(1)
+	start := time.Now()
+	done, failed := it.job(ctx)
+	p.inProgress.Add(-1)
+	if done+failed == 0 {
+		return
+	}
+	p.busy.Add(int64(time.Since(start)))
+	p.jobs.Add(1)
+	p.done.Add(int64(done))
+	p.failed.Add(int64(failed))
+}
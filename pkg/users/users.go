@@ -0,0 +1,137 @@
+package users
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/dddpaul/alfafin-bot/pkg/storage"
+)
+
+// User is a Telegram user with own Google Apps Script web app, expenses and history
+type User struct {
+	ID              int64  `yaml:"id" json:"id"`
+	Username        string `yaml:"username" json:"username,omitempty"`
+	GASURL          string `yaml:"gas_url" json:"gas_url"`
+	GASProxyURL     string `yaml:"gas_proxy_url" json:"gas_proxy_url,omitempty"`
+	GASClientID     string `yaml:"gas_client_id" json:"gas_client_id,omitempty"`
+	GASClientSecret string `yaml:"gas_client_secret" json:"gas_client_secret,omitempty"`
+}
+
+// Registry maps Telegram users to their settings
+type Registry struct {
+	mu    sync.Mutex
+	path  string
+	Users []*User `json:"users"`
+}
+
+// New returns registry persisted to the file at specified path or kept in memory if path is empty
+func New(path string) (*Registry, error) {
+	r := &Registry{path: path}
+	if path != "" {
+		if err := storage.Load(path, r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// LoadFile registers users from YAML or JSON file, users already registered with the same ID are replaced
+func (r *Registry) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f struct {
+		Users []*User `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, u := range f.Users {
+		if err := r.Register(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns copy of the user settings or nil if user is not registered
+func (r *Registry) Get(id int64) *User {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.index(id); i >= 0 {
+		u := *r.Users[i]
+		return &u
+	}
+	return nil
+}
+
+// Register adds user or replaces settings of already registered one
+func (r *Registry) Register(u *User) error {
+	if u.ID == 0 || u.GASURL == "" {
+		return fmt.Errorf("user ID and GAS URL have to be specified")
+	}
+	if err := ValidateGASURL(u.GASURL); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u1 := *u
+	if i := r.index(u.ID); i >= 0 {
+		r.Users[i] = &u1
+	} else {
+		r.Users = append(r.Users, &u1)
+	}
+	return r.save()
+}
+
+// ValidateGASURL checks that GAS URL is an absolute HTTP or HTTPS URL
+func ValidateGASURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid GAS URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid GAS URL %q: http or https URL is expected", s)
+	}
+	return nil
+}
+
+// Unregister removes user, returns false if user was not registered
+func (r *Registry) Unregister(id int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(id)
+	if i < 0 {
+		return false, nil
+	}
+	r.Users = slices.Delete(r.Users, i, i+1)
+	return true, r.save()
+}
+
+// List returns copy of all registered users
+func (r *Registry) List() []User {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	uu := make([]User, 0, len(r.Users))
+	for _, u := range r.Users {
+		uu = append(uu, *u)
+	}
+	return uu
+}
+
+func (r *Registry) index(id int64) int {
+	return slices.IndexFunc(r.Users, func(u *User) bool { return u.ID == id })
+}
+
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	return storage.Save(r.path, r)
+}